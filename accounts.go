@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+)
+
+// deleteAccount deletes the caller's account for good. The password, and the
+// second factor when enabled, must be given again so a stolen access token is
+// not enough.
+func (c *apiConfig) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		// Chirps is "delete", the default, or "anonymize" to keep public
+		// chirps without an author.
+		Chirps string `json:"chirps"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+	if req.Chirps != "" && req.Chirps != "delete" && req.Chirps != "anonymize" {
+		respondWithError(w, http.StatusBadRequest, `chirps must be "delete" or "anonymize"`)
+		return
+	}
+
+	user, err := c.db.FindUserById(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if ok := c.reauthenticate(w, r, user, req.Password); !ok {
+		return
+	}
+	if user.TOTPEnabled {
+		err = c.verifySecondFactor(user, req.Code, req.RecoveryCode)
+		if err != nil {
+			c.throttle.recordFailure(accountKey(user.Email), ipKey(r))
+			respondWithError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+
+	err = c.db.DeleteUser(user.ID, req.Chirps == "anonymize")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete account")
+		return
+	}
+	c.throttle.reset(accountKey(user.Email))
+	log.Printf("Deleted user %d", user.ID)
+	c.recordEvent(r, audit.Event{Action: actionAccountDelete, Outcome: audit.OutcomeSuccess, Detail: "chirps: " + req.Chirps})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// exportAccount sends the caller a zip archive with one JSON file for each
+// kind of data stored about them.
+func (c *apiConfig) exportAccount(w http.ResponseWriter, r *http.Request) {
+	export, err := c.db.ExportUser(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	files := []struct {
+		name string
+		data any
+	}{
+		{"profile.json", export.Profile},
+		{"chirps.json", export.Chirps},
+		{"following.json", export.Following},
+		{"followers.json", export.Followers},
+		{"sessions.json", export.Sessions},
+		{"api_keys.json", export.APIKeys},
+		{"oauth_clients.json", export.OAuthClients},
+		{"identities.json", export.Identities},
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chirpy-export-%d.zip"`, export.Profile.ID))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Deflate,
+			Modified: export.Profile.ExportedAt,
+		})
+		if err != nil {
+			log.Printf("Failed to write export of user %d: %s", export.Profile.ID, err)
+			return
+		}
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.data)
+		if err != nil {
+			log.Printf("Failed to write export of user %d: %s", export.Profile.ID, err)
+			return
+		}
+	}
+	err = archive.Close()
+	if err != nil {
+		log.Printf("Failed to write export of user %d: %s", export.Profile.ID, err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+const (
+	defaultUsersPerPage = 50
+	maxUsersPerPage     = 200
+	// impersonationLifetime is how long support can act as a user before
+	// having to start over.
+	impersonationLifetime = 15 * time.Minute
+	maxAdminReasonLength  = 500
+)
+
+type adminUserResponse struct {
+	ID                    int                  `json:"id"`
+	Email                 string               `json:"email"`
+	Role                  string               `json:"role"`
+	IsChirpyRed           bool                 `json:"is_chirpy_red"`
+	EmailVerified         bool                 `json:"email_verified"`
+	TOTPEnabled           bool                 `json:"totp_enabled"`
+	SuspendedAt           *time.Time           `json:"suspended_at,omitempty"`
+	SuspensionReason      string               `json:"suspension_reason,omitempty"`
+	PasswordResetRequired bool                 `json:"password_reset_required"`
+	Subscription          subscriptionResponse `json:"subscription"`
+}
+
+func presentAdminUser(user database.User) adminUserResponse {
+	return adminUserResponse{
+		ID:                    user.ID,
+		Email:                 user.Email,
+		Role:                  userRole(user),
+		IsChirpyRed:           user.IsChirpyRed,
+		EmailVerified:         user.EmailVerified,
+		TOTPEnabled:           user.TOTPEnabled,
+		SuspendedAt:           user.SuspendedAt,
+		SuspensionReason:      user.SuspensionReason,
+		PasswordResetRequired: user.PasswordResetRequired,
+		Subscription:          presentSubscription(user),
+	}
+}
+
+// recordAdminAction adds what an admin did to a user to the audit log.
+func (c *apiConfig) recordAdminAction(r *http.Request, action string, targetId int, detail string) {
+	c.recordEvent(r, audit.Event{Action: action, TargetID: targetId, Outcome: audit.OutcomeSuccess, Detail: detail})
+}
+
+// adminTarget reads the user an admin endpoint acts on from the path,
+// answering the request itself when there is no such user.
+func (c *apiConfig) adminTarget(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return database.User{}, false
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return database.User{}, false
+	}
+
+	return user, true
+}
+
+// decodeAdminReason reads the reason an admin gives for an action, which is
+// kept in the audit trail.
+func decodeAdminReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	type Req struct {
+		Reason string `json:"reason"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return "", false
+	}
+	if req.Reason == "" {
+		respondWithError(w, http.StatusBadRequest, "Please provide a reason")
+		return "", false
+	}
+	if len(req.Reason) > maxAdminReasonLength {
+		respondWithError(w, http.StatusBadRequest, "Reason is too long")
+		return "", false
+	}
+
+	return req.Reason, true
+}
+
+// listUsers searches users by email or id, a page at a time.
+func (c *apiConfig) listUsers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	page, perPage := 1, defaultUsersPerPage
+	if v := query.Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			respondWithError(w, http.StatusBadRequest, "page must be a positive number")
+			return
+		}
+		page = n
+	}
+	if v := query.Get("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxUsersPerPage {
+			respondWithError(w, http.StatusBadRequest, "per_page must be between 1 and "+strconv.Itoa(maxUsersPerPage))
+			return
+		}
+		perPage = n
+	}
+
+	users, total, err := c.db.SearchUsers(query.Get("q"), (page-1)*perPage, perPage)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type Res struct {
+		Users   []adminUserResponse `json:"users"`
+		Page    int                 `json:"page"`
+		PerPage int                 `json:"per_page"`
+		Total   int                 `json:"total"`
+	}
+
+	res := Res{Users: []adminUserResponse{}, Page: page, PerPage: perPage, Total: total}
+	for _, v := range users {
+		res.Users = append(res.Users, presentAdminUser(v))
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// getUser shows an account with its activity and sessions.
+func (c *apiConfig) getUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	activity, err := c.db.GetUserActivity(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sessions, err := c.db.ListSessions(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	type session struct {
+		ID         string    `json:"id"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		UserAgent  string    `json:"user_agent"`
+		IP         string    `json:"ip"`
+		ClientId   string    `json:"client_id,omitempty"`
+	}
+
+	type Res struct {
+		adminUserResponse
+		Activity database.UserActivity `json:"activity"`
+		Sessions []session             `json:"sessions"`
+	}
+
+	res := Res{adminUserResponse: presentAdminUser(user), Activity: activity, Sessions: []session{}}
+	for _, v := range sessions {
+		res.Sessions = append(res.Sessions, session{
+			ID:         v.ID,
+			CreatedAt:  v.CreatedAt,
+			LastUsedAt: v.LastUsedAt,
+			UserAgent:  v.UserAgent,
+			IP:         v.IP,
+			ClientId:   v.ClientId,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// suspendUser blocks an account and logs it out everywhere.
+func (c *apiConfig) suspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	reason, ok := decodeAdminReason(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == requestPrincipal(r).UserID {
+		respondWithError(w, http.StatusForbidden, "You cannot suspend yourself")
+		return
+	}
+
+	user, err := c.db.SuspendUser(user.ID, reason)
+	if errors.Is(err, database.ErrUserSuspended) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordAdminAction(r, actionAdminSuspend, user.ID, reason)
+
+	respondWithJSON(w, http.StatusOK, presentAdminUser(user))
+}
+
+func (c *apiConfig) unsuspendUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	user, err := c.db.UnsuspendUser(user.ID)
+	if errors.Is(err, database.ErrUserNotSuspended) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordAdminAction(r, actionAdminUnsuspend, user.ID, "")
+
+	respondWithJSON(w, http.StatusOK, presentAdminUser(user))
+}
+
+// forcePasswordReset logs a user out everywhere and makes them choose a new
+// password through the emailed reset link before logging in again.
+func (c *apiConfig) forcePasswordReset(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	reason, ok := decodeAdminReason(w, r)
+	if !ok {
+		return
+	}
+
+	err := c.db.RequirePasswordReset(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordAdminAction(r, actionAdminPasswordReset, user.ID, reason)
+
+	err = c.sendActionToken(user, database.PurposePasswordReset, user.Email, passwordResetLifetime,
+		"Reset your Chirpy password",
+		"The Chirpy team has logged you out and asks you to choose a new password. Open the link below to set one.",
+		"/app/reset-password")
+	if err != nil {
+		log.Printf("Failed to issue password reset token: %s", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to send password reset email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// setChirpyRed grants or revokes Chirpy Red by hand, for support cases the
+// payment provider did not handle. A grant starts an admin subscription that
+// lasts until expires_at, or for good when it is not given, a revocation
+// ends the user's subscription right away.
+func (c *apiConfig) setChirpyRed(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+
+	type Req struct {
+		IsChirpyRed *bool      `json:"is_chirpy_red"`
+		ExpiresAt   *time.Time `json:"expires_at"`
+		Reason      string     `json:"reason"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil || req.IsChirpyRed == nil {
+		respondWithError(w, http.StatusBadRequest, "Please provide is_chirpy_red")
+		return
+	}
+	if req.ExpiresAt != nil && (!*req.IsChirpyRed || !req.ExpiresAt.After(time.Now())) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future and only given with a grant")
+		return
+	}
+
+	detail := "revoked"
+	if *req.IsChirpyRed {
+		detail = "granted"
+		if req.ExpiresAt != nil {
+			expiresAt := req.ExpiresAt.UTC()
+			req.ExpiresAt = &expiresAt
+			detail += " until " + expiresAt.Format(time.RFC3339)
+		}
+		user, err = c.db.StartSubscription(user.ID, database.PlanChirpyRed, database.SubscriptionSourceAdmin, req.ExpiresAt)
+	} else if user.IsChirpyRed {
+		user, err = c.db.EndSubscription(user.ID, database.SubscriptionExpired)
+	} else {
+		err = database.ErrNoSubscription
+	}
+	if errors.Is(err, database.ErrNoSubscription) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if req.Reason != "" {
+		detail += ": " + req.Reason
+	}
+	c.recordAdminAction(r, actionAdminChirpyRed, user.ID, detail)
+
+	respondWithJSON(w, http.StatusOK, presentAdminUser(user))
+}
+
+// impersonateUser issues a short-lived token to act as a user for support.
+// The token carries the admin in its act claim, only holds the scopes an API
+// key could, so account settings and admin endpoints stay out of reach, and
+// every request made with it is logged.
+func (c *apiConfig) impersonateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.adminTarget(w, r)
+	if !ok {
+		return
+	}
+	reason, ok := decodeAdminReason(w, r)
+	if !ok {
+		return
+	}
+
+	adminId := requestPrincipal(r).UserID
+	if user.ID == adminId {
+		respondWithError(w, http.StatusBadRequest, "You cannot impersonate yourself")
+		return
+	}
+	if user.SuspendedAt != nil {
+		respondWithError(w, http.StatusConflict, "Suspended users cannot be impersonated")
+		return
+	}
+
+	lifetime := int(impersonationLifetime.Seconds())
+	token, err := auth.GenerateImpersonationToken(c.keys, user.ID, lifetime, adminId, auth.GrantableScopes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate JWT")
+		return
+	}
+	c.recordAdminAction(r, actionAdminImpersonate, user.ID, reason)
+
+	type Res struct {
+		Token         string    `json:"token"`
+		UserId        int       `json:"user_id"`
+		Scopes        []string  `json:"scopes"`
+		ExpiresAt     time.Time `json:"expires_at"`
+		Impersonation bool      `json:"impersonation"`
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{
+		Token:         token,
+		UserId:        user.ID,
+		Scopes:        auth.GrantableScopes,
+		ExpiresAt:     time.Now().UTC().Add(impersonationLifetime),
+		Impersonation: true,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+// viewCounter aggregates chirp impressions in memory so serving chirps does
+// not rewrite the database, they are flushed periodically by flushChirpViews.
+type viewCounter struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+func newViewCounter() *viewCounter {
+	return &viewCounter{counts: map[int]int{}}
+}
+
+// record counts one impression of each chirp served to viewerId, authors
+// viewing their own chirps are not counted. Anonymous viewers are always
+// counted, even on anonymized chirps whose AuthorId is also 0.
+func (v *viewCounter) record(viewerId int, chirps ...database.Chirp) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for _, chirp := range chirps {
+		if viewerId == 0 || chirp.AuthorId != viewerId {
+			v.counts[chirp.ID]++
+		}
+	}
+}
+
+func (v *viewCounter) drain() map[int]int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	counts := v.counts
+	v.counts = map[int]int{}
+	return counts
+}
+
+func (c *apiConfig) flushChirpViews(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		counts := c.views.drain()
+		if len(counts) == 0 {
+			continue
+		}
+
+		err := c.db.RecordChirpViews(time.Now(), counts)
+		if err != nil {
+			log.Printf("Failed to flush chirp views: %s", err)
+		}
+	}
+}
+
+func (c *apiConfig) getAnalytics(w http.ResponseWriter, r *http.Request) {
+	principal := requestPrincipal(r)
+
+	const maxAnalyticsDays = 366
+	var err error
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	from := to.AddDate(0, 0, -29)
+	if v := r.URL.Query().Get("to"); v != "" {
+		to, err = time.Parse(database.DateLayout, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "to must be a date formatted as YYYY-MM-DD")
+			return
+		}
+		from = to.AddDate(0, 0, -29)
+	}
+	if v := r.URL.Query().Get("from"); v != "" {
+		from, err = time.Parse(database.DateLayout, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "from must be a date formatted as YYYY-MM-DD")
+			return
+		}
+	}
+	if from.After(to) || to.Sub(from) >= maxAnalyticsDays*24*time.Hour {
+		respondWithError(w, http.StatusBadRequest, "Date range must be between 1 and 366 days")
+		return
+	}
+
+	analytics, err := c.db.AuthorAnalytics(principal.UserID, from, to)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// Chirpy Red members get the daily and per-chirp breakdown, everyone else
+	// only the totals
+	type Res struct {
+		From         string                `json:"from"`
+		To           string                `json:"to"`
+		TotalViews   int                   `json:"total_views"`
+		NewFollowers int                   `json:"new_followers"`
+		Followers    int                   `json:"followers"`
+		Daily        []database.DailyStats `json:"daily,omitempty"`
+		Chirps       []database.ChirpStats `json:"chirps,omitempty"`
+	}
+
+	res := Res{
+		From:      from.Format(database.DateLayout),
+		To:        to.Format(database.DateLayout),
+		Followers: analytics.Followers,
+	}
+	for _, v := range analytics.Days {
+		res.TotalViews += v.Views
+		res.NewFollowers += v.NewFollowers
+	}
+	if principal.Tier == auth.TierRed {
+		res.Daily = analytics.Days
+		res.Chirps = analytics.Chirps
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
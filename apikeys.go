@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+const (
+	maxAPIKeyNameLength = 100
+	maxAPIKeysPerUser   = 50
+	// apiKeyPrefixLength is how much of a key is kept in the clear, enough to
+	// recognize it in a list without making it guessable.
+	apiKeyPrefixLength = len(auth.APIKeyPrefix) + 8
+)
+
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+func presentAPIKey(key database.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+	}
+}
+
+// createAPIKey creates a personal API key. The key is only part of this
+// response, it cannot be retrieved again.
+func (c *apiConfig) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Req struct {
+		Name             string   `json:"name"`
+		Scopes           []string `json:"scopes"`
+		ExpiresInSeconds int      `json:"expires_in_seconds"`
+	}
+	type Res struct {
+		apiKeyResponse
+		Key string `json:"key"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	if len(req.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Please provide at least one scope")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, http.StatusBadRequest, "Unknown scope "+scope)
+			return
+		}
+	}
+	if req.ExpiresInSeconds < 0 {
+		respondWithError(w, http.StatusBadRequest, "expires_in_seconds must not be negative")
+		return
+	}
+
+	existing, err := c.db.ListAPIKeys(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(existing) >= maxAPIKeysPerUser {
+		respondWithError(w, http.StatusConflict, "Too many API keys, revoke one first")
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInSeconds > 0 {
+		t := time.Now().UTC().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expiresAt = &t
+	}
+
+	secret, err := auth.GenerateAPIKey()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate API key")
+		return
+	}
+
+	key, err := c.db.CreateAPIKey(userId, req.Name, auth.HashAPIKey(secret), secret[:apiKeyPrefixLength], req.Scopes, expiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.recordEvent(r, audit.Event{
+		Action:  actionAPIKeyCreate,
+		Outcome: audit.OutcomeSuccess,
+		Detail:  "key " + key.ID + " with " + strings.Join(key.Scopes, " "),
+	})
+
+	respondWithJSON(w, http.StatusCreated, Res{apiKeyResponse: presentAPIKey(key), Key: secret})
+}
+
+func (c *apiConfig) getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := c.db.ListAPIKeys(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := []apiKeyResponse{}
+	for _, v := range keys {
+		res = append(res, presentAPIKey(v))
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (c *apiConfig) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	err := c.db.RevokeAPIKey(requestPrincipal(r).UserID, r.PathValue("id"))
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke API key")
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionAPIKeyRevoke, Outcome: audit.OutcomeSuccess, Detail: "key " + r.PathValue("id")})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+)
+
+// Actions recorded in the audit log.
+const (
+	actionLogin               = "login"
+	actionTokenRefresh        = "token.refresh"
+	actionTokenRevoke         = "token.revoke"
+	actionSessionRevoke       = "session.revoke"
+	actionSessionRevokeAll    = "session.revoke_all"
+	actionPasswordChange      = "password.change"
+	actionPasswordReset       = "password.reset"
+	actionEmailVerify         = "email.verify"
+	actionEmailChange         = "email.change"
+	actionMFAEnable           = "mfa.enable"
+	actionMFADisable          = "mfa.disable"
+	actionAPIKeyCreate        = "api_key.create"
+	actionAPIKeyRevoke        = "api_key.revoke"
+	actionOAuthClientCreate   = "oauth_client.create"
+	actionOAuthClientDelete   = "oauth_client.delete"
+	actionOAuthAuthorize      = "oauth.authorize"
+	actionAccountDelete       = "account.delete"
+	actionChirpyRedUpgrade    = "chirpy_red.upgrade"
+	actionChirpyRedRenew      = "chirpy_red.renew"
+	actionChirpyRedCancel     = "chirpy_red.cancel"
+	actionChirpyRedPastDue    = "chirpy_red.past_due"
+	actionChirpyRedRefund     = "chirpy_red.refund"
+	actionChirpyRedExpire     = "chirpy_red.expire"
+	actionWebhookRejected     = "webhook.rejected"
+	actionAdminRole           = "admin.role"
+	actionAdminSuspend        = "admin.suspend"
+	actionAdminUnsuspend      = "admin.unsuspend"
+	actionAdminPasswordReset  = "admin.password_reset"
+	actionAdminChirpyRed      = "admin.chirpy_red"
+	actionAdminImpersonate    = "admin.impersonate"
+	actionAdminWebhookReplay  = "admin.webhook_replay"
+	actionImpersonatedRequest = "admin.impersonated_request"
+)
+
+const (
+	defaultAuditEventsLimit = 100
+	maxAuditEventsLimit     = 1000
+)
+
+// recordEvent adds e to the audit log, filling in who made r and from where.
+// r is nil for events from background jobs. Failures are only logged, an
+// unwritable audit log does not take the API down.
+func (c *apiConfig) recordEvent(r *http.Request, e audit.Event) {
+	if r != nil {
+		principal := requestPrincipal(r)
+		if e.ActorID == 0 {
+			e.ActorID = principal.UserID
+		}
+		if e.ImpersonatorID == 0 {
+			e.ImpersonatorID = principal.ImpersonatorID
+		}
+		e.IP = clientIP(r)
+		e.UserAgent = r.UserAgent()
+	}
+
+	err := c.audit.Record(e)
+	if err != nil {
+		log.Printf("Failed to record audit event %s: %s", e.Action, err)
+	}
+}
+
+// outcome maps the error of an audited operation to its outcome.
+func outcome(err error) string {
+	if err != nil {
+		return audit.OutcomeFailure
+	}
+	return audit.OutcomeSuccess
+}
+
+// parseAuditFilter reads the user_id, action, outcome, since and until query
+// parameters shared by the audit endpoints.
+func parseAuditFilter(w http.ResponseWriter, r *http.Request) (audit.Filter, bool) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Action:  query.Get("action"),
+		Outcome: query.Get("outcome"),
+	}
+
+	if v := query.Get("user_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "user_id must be a number")
+			return audit.Filter{}, false
+		}
+		filter.UserID = id
+	}
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return audit.Filter{}, false
+		}
+		filter.Since = t
+	}
+	if v := query.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "until must be an RFC 3339 timestamp")
+			return audit.Filter{}, false
+		}
+		filter.Until = t
+	}
+
+	return filter, true
+}
+
+// getAuditEvents returns the most recent audit events matching the filters.
+func (c *apiConfig) getAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseAuditFilter(w, r)
+	if !ok {
+		return
+	}
+
+	limit := defaultAuditEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditEventsLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditEventsLimit))
+			return
+		}
+		limit = n
+	}
+
+	events, err := c.audit.Query(filter, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to read audit log")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
+
+// exportAuditEvents streams every audit event matching the filters as JSON
+// Lines, oldest first.
+func (c *apiConfig) exportAuditEvents(w http.ResponseWriter, r *http.Request) {
+	filter, ok := parseAuditFilter(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-audit.jsonl"`)
+	w.WriteHeader(http.StatusOK)
+	err := c.audit.Export(w, filter)
+	if err != nil {
+		log.Printf("Failed to export audit log: %s", err)
+	}
+}
+
+// pruneAuditLog drops audit events once they are older than the audit
+// retention period. It runs until the process exits.
+func (c *apiConfig) pruneAuditLog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		pruned, err := c.audit.Prune(time.Now().UTC().Add(-c.auditRetention))
+		if err != nil {
+			log.Printf("Failed to prune audit log: %s", err)
+			continue
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d audit events", pruned)
+		}
+	}
+}
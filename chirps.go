@@ -2,59 +2,98 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/abi-liu/chirpy/internal/auth"
 	"github.com/abi-liu/chirpy/internal/database"
 )
 
-func (c *apiConfig) postChirp(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	arr := strings.Split(authHeader, "Bearer ")
-	if len(arr) < 2 {
-		respondWithError(w, http.StatusUnauthorized, "Token not provided")
-		return
+const maxContentWarningLength = 100
+
+// chirpResponse is a chirp as served to a reader. Flagged chirps are collapsed,
+// with the body withheld, unless the reader chose to auto-expand them.
+type chirpResponse struct {
+	database.Chirp
+	Collapsed bool `json:"collapsed"`
+}
+
+func presentChirp(file database.File, chirp database.Chirp, viewerId int) chirpResponse {
+	expand := viewerId != 0 && chirp.AuthorId == viewerId
+	if viewer, ok := file.UserById(viewerId); ok && viewer.SensitiveMedia == database.SensitiveMediaExpand {
+		expand = true
 	}
-	tokenStr := arr[1]
 
-	stringId, err := auth.ParseToken(tokenStr, c.jwt)
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Token expired")
-		return
+	if !chirp.IsFlagged() || expand {
+		return chirpResponse{Chirp: chirp}
 	}
 
-	id, err := strconv.Atoi(stringId)
+	chirp.Body = ""
+	return chirpResponse{Chirp: chirp, Collapsed: true}
+}
+
+func (c *apiConfig) postChirp(w http.ResponseWriter, r *http.Request) {
+	id := requestPrincipal(r).UserID
+
+	decoder := json.NewDecoder(r.Body)
+	params := chirpParams{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Cannot convert to int")
+		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
 		return
 	}
 
-	type parameters struct {
-		Body string `json:"body"`
-	}
-	type returnVals struct {
-		ID       int    `json:"id"`
-		Body     string `json:"body"`
-		AuthorId int    `json:"author_id"`
+	chirp, err := newChirp(params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err = decoder.Decode(&params)
+	chirp.AuthorId = id
+	chirp, err = c.db.AddChirp(chirp)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	respondWithJSON(w, http.StatusCreated, chirp)
+}
+
+type chirpParams struct {
+	Body           string `json:"body"`
+	Visibility     string `json:"visibility"`
+	Mentions       []int  `json:"mentions"`
+	ContentWarning string `json:"content_warning"`
+	Sensitive      bool   `json:"sensitive"`
+}
+
+// newChirp validates params and builds the chirp to store, with profane words
+// censored. The caller assigns the id and author.
+func newChirp(params chirpParams) (database.Chirp, error) {
 	const maxChirpLength = 140
 	if len(params.Body) > maxChirpLength {
-		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
-		return
+		return database.Chirp{}, errors.New("Chirp is too long")
+	}
+
+	if len(params.ContentWarning) > maxContentWarningLength {
+		return database.Chirp{}, errors.New("Content warning is too long")
+	}
+
+	visibility := params.Visibility
+	if visibility == "" {
+		visibility = database.VisibilityPublic
+	}
+	if visibility != database.VisibilityPublic && visibility != database.VisibilityFollowers && visibility != database.VisibilityMentioned {
+		return database.Chirp{}, errors.New("Visibility must be one of public, followers or mentioned")
+	}
+	if visibility == database.VisibilityMentioned && len(params.Mentions) == 0 {
+		return database.Chirp{}, errors.New("Mentioned-only chirps must mention at least one user")
 	}
 
 	chirpSlice := strings.Fields(params.Body)
@@ -64,23 +103,13 @@ func (c *apiConfig) postChirp(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	c.UID++
-	chirp := database.Chirp{
-		ID:       c.UID,
-		Body:     strings.Join(chirpSlice, " "),
-		AuthorId: id,
-	}
-	err = c.db.AddChirp(chirp)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	respondWithJSON(w, http.StatusCreated, returnVals{
-		ID:       c.UID,
-		Body:     strings.Join(chirpSlice, " "),
-		AuthorId: id,
-	})
+	return database.Chirp{
+		Body:           strings.Join(chirpSlice, " "),
+		Visibility:     visibility,
+		Mentions:       params.Mentions,
+		ContentWarning: params.ContentWarning,
+		Sensitive:      params.Sensitive,
+	}, nil
 }
 
 func (c *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
@@ -90,20 +119,27 @@ func (c *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// anonymous callers only see public chirps, optionalAuth has already
+	// refused requests with an invalid token
+	viewerId := requestPrincipal(r).UserID
+
 	strId := r.URL.Query().Get("author_id")
 	sortBy := r.URL.Query().Get("sort")
 	chirps := []database.Chirp{}
 	if strId == "" {
 		for _, v := range file.Chirps {
-			chirps = append(chirps, v)
+			if !v.IsDeleted() && file.CanViewChirp(v, viewerId) {
+				chirps = append(chirps, v)
+			}
 		}
 	} else {
 		id, err := strconv.Atoi(strId)
 		if err != nil {
 			respondWithError(w, http.StatusBadRequest, "Please enter a valid author id")
+			return
 		}
 		for _, v := range file.Chirps {
-			if v.AuthorId == id {
+			if v.AuthorId == id && !v.IsDeleted() && file.CanViewChirp(v, viewerId) {
 				chirps = append(chirps, v)
 			}
 		}
@@ -113,7 +149,13 @@ func (c *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 			return chirps[a].ID > chirps[b].ID
 		})
 	}
-	respondWithJSON(w, http.StatusOK, chirps)
+
+	res := []chirpResponse{}
+	for _, v := range chirps {
+		res = append(res, presentChirp(file, v, viewerId))
+	}
+	c.views.record(viewerId, chirps...)
+	respondWithJSON(w, http.StatusOK, res)
 
 }
 
@@ -125,33 +167,34 @@ func (c *apiConfig) getChirpById(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	chirp, err := c.db.GetChirpById(id)
+	file, err := c.db.ReadFile()
 	if err != nil {
-		log.Printf("Cannot find Chirp with id %d", id)
-		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Cannot find chirp with id %d", id))
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, chirp)
-}
+	viewerId := requestPrincipal(r).UserID
 
-func (c *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	arr := strings.Split(authHeader, "Bearer ")
-	if len(arr) < 2 {
-		respondWithError(w, http.StatusUnauthorized, "Token missing")
+	// hidden chirps are reported as missing so their existence is not leaked
+	chirp, ok := file.Chirps[id]
+	if !ok || !file.CanViewChirp(chirp, viewerId) {
+		log.Printf("Cannot find Chirp with id %d", id)
+		respondWithError(w, http.StatusNotFound, fmt.Sprintf("Cannot find chirp with id %d", id))
 		return
 	}
-	token := arr[1]
-	userId, err := auth.ParseToken(token, c.jwt)
-
-	intUser, _ := strconv.Atoi(userId)
 
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+	if chirp.IsDeleted() {
+		respondWithError(w, http.StatusGone, fmt.Sprintf("Chirp with id %d has been deleted", id))
 		return
 	}
 
+	c.views.record(viewerId, chirp)
+	respondWithJSON(w, http.StatusOK, presentChirp(file, chirp, viewerId))
+}
+
+func (c *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
+	intUser := requestPrincipal(r).UserID
+
 	chirpId := r.PathValue("id")
 	intId, err := strconv.Atoi(chirpId)
 	if err != nil {
@@ -161,7 +204,7 @@ func (c *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
 
 	chirp, err := c.db.GetChirpById(intId)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Chirp not found")
+		respondWithChirpError(w, err)
 		return
 	}
 
@@ -172,9 +215,247 @@ func (c *apiConfig) deleteChirpById(w http.ResponseWriter, r *http.Request) {
 
 	err = c.db.DeleteChirpById(intId)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to delete chirp")
+		respondWithChirpError(w, err)
 		return
 	}
 
 	respondWithJSON(w, http.StatusNoContent, ``)
 }
+
+// updateContentWarning sets the content warning of a chirp, which its author
+// and moderators may do.
+func (c *apiConfig) updateContentWarning(w http.ResponseWriter, r *http.Request) {
+	principal := requestPrincipal(r)
+
+	chirpId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid chirp id")
+		return
+	}
+
+	type Req struct {
+		ContentWarning string `json:"content_warning"`
+		Sensitive      bool   `json:"sensitive"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err = decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	if len(req.ContentWarning) > maxContentWarningLength {
+		respondWithError(w, http.StatusBadRequest, "Content warning is too long")
+		return
+	}
+
+	chirp, err := c.db.GetChirpById(chirpId)
+	if err != nil {
+		respondWithChirpError(w, err)
+		return
+	}
+
+	if chirp.AuthorId != principal.UserID && !principal.HasPermission(auth.PermModerateChirps) {
+		respondWithError(w, http.StatusForbidden, "You are not allowed to edit this chirp")
+		return
+	}
+
+	chirp, err = c.db.SetContentWarning(chirpId, req.ContentWarning, req.Sensitive)
+	if err != nil {
+		respondWithChirpError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+func (c *apiConfig) restoreChirp(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	chirpId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid chirp id")
+		return
+	}
+
+	chirp, err := c.db.GetChirpById(chirpId)
+	if err != nil && !errors.Is(err, database.ErrChirpDeleted) {
+		respondWithChirpError(w, err)
+		return
+	}
+
+	if chirp.AuthorId != userId {
+		respondWithError(w, http.StatusForbidden, "You are not allowed to restore this chirp")
+		return
+	}
+
+	chirp, err = c.db.RestoreChirp(chirpId, c.undoWindow)
+	if err != nil {
+		respondWithChirpError(w, err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chirp)
+}
+
+// purgeDeletedChirps hard-deletes soft-deleted chirps once they are older than
+// the retention period. It runs until the process exits.
+func (c *apiConfig) purgeDeletedChirps(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purged, err := c.db.PurgeDeletedChirps(time.Now().UTC().Add(-c.retention))
+		if err != nil {
+			log.Printf("Failed to purge deleted chirps: %s", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted chirps", purged)
+		}
+	}
+}
+
+func respondWithChirpError(w http.ResponseWriter, err error) {
+	respondWithError(w, chirpErrorStatus(err), err.Error())
+}
+
+func chirpErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, database.ErrChirpNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, database.ErrChirpDeleted), errors.Is(err, database.ErrUndoWindowExpired):
+		return http.StatusGone
+	case errors.Is(err, database.ErrChirpNotDeleted):
+		return http.StatusConflict
+	case errors.Is(err, database.ErrNotChirpAuthor):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+const maxBatchOperations = 100
+
+// batchChirps creates and deletes many chirps with a single database write.
+// Invalid operations are reported per item, unless the request is atomic in
+// which case any failure aborts the whole batch.
+func (c *apiConfig) batchChirps(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type operation struct {
+		Op string `json:"op"`
+		ID int    `json:"id"`
+		chirpParams
+	}
+	type Req struct {
+		Atomic     bool        `json:"atomic"`
+		Operations []operation `json:"operations"`
+	}
+	type result struct {
+		Index  int             `json:"index"`
+		Op     string          `json:"op"`
+		Status int             `json:"status"`
+		Chirp  *database.Chirp `json:"chirp,omitempty"`
+		Error  string          `json:"error,omitempty"`
+	}
+	type Res struct {
+		Succeeded int      `json:"succeeded"`
+		Failed    int      `json:"failed"`
+		Results   []result `json:"results"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Couldn't decode parameters")
+		return
+	}
+
+	if len(req.Operations) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Batch contains no operations")
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		respondWithError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("A batch can contain at most %d operations", maxBatchOperations))
+		return
+	}
+
+	// validate every operation up front, only valid ones reach the database
+	results := make([]result, len(req.Operations))
+	ops := []database.ChirpOp{}
+	opIndex := []int{}
+	for i, v := range req.Operations {
+		results[i] = result{Index: i, Op: v.Op}
+		switch v.Op {
+		case "create":
+			chirp, err := newChirp(v.chirpParams)
+			if err != nil {
+				results[i].Status = http.StatusBadRequest
+				results[i].Error = err.Error()
+				continue
+			}
+			chirp.AuthorId = userId
+			results[i].Chirp = &chirp
+			ops = append(ops, database.ChirpOp{Create: &chirp})
+		case "delete":
+			ops = append(ops, database.ChirpOp{Delete: v.ID})
+		default:
+			results[i].Status = http.StatusBadRequest
+			results[i].Error = "Operation must be either create or delete"
+			continue
+		}
+		opIndex = append(opIndex, i)
+	}
+
+	aborted := req.Atomic && len(ops) != len(req.Operations)
+	if !aborted {
+		opErrs, err := c.db.ApplyChirpOps(userId, ops, req.Atomic)
+		if err != nil && !errors.Is(err, database.ErrBatchAborted) {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		aborted = err != nil
+
+		for j, opErr := range opErrs {
+			i := opIndex[j]
+			if opErr != nil {
+				results[i].Status = chirpErrorStatus(opErr)
+				results[i].Error = opErr.Error()
+			}
+		}
+	}
+
+	res := Res{Results: results}
+	for i := range res.Results {
+		if res.Results[i].Status == 0 && aborted {
+			res.Results[i].Status = http.StatusFailedDependency
+			res.Results[i].Error = database.ErrBatchAborted.Error()
+			res.Results[i].Chirp = nil
+		}
+		if res.Results[i].Status == 0 {
+			res.Results[i].Status = http.StatusOK
+			if res.Results[i].Op == "create" {
+				res.Results[i].Status = http.StatusCreated
+			}
+		}
+
+		if res.Results[i].Error == "" {
+			res.Succeeded++
+		} else {
+			res.Failed++
+		}
+	}
+
+	switch {
+	case res.Failed == 0:
+		respondWithJSON(w, http.StatusOK, res)
+	case res.Succeeded == 0:
+		respondWithJSON(w, http.StatusUnprocessableEntity, res)
+	default:
+		respondWithJSON(w, http.StatusMultiStatus, res)
+	}
+}
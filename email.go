@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+	"github.com/abi-liu/chirpy/internal/mailer"
+)
+
+const (
+	passwordResetLifetime     = time.Hour
+	emailVerificationLifetime = 48 * time.Hour
+	emailChangeLifetime       = 24 * time.Hour
+)
+
+// sendMail delivers msg in the background so slow mail servers do not hold
+// up requests, or reveal through timing whether an account exists.
+func (c *apiConfig) sendMail(msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		err := c.mailer.Send(ctx, msg)
+		if err != nil {
+			log.Printf("Failed to send %q email: %s", msg.Subject, err)
+		}
+	}()
+}
+
+// sendActionToken issues a single-use token of the given purpose for user and
+// emails a link carrying it to email.
+func (c *apiConfig) sendActionToken(user database.User, purpose, email string, ttl time.Duration, subject, text, path string) error {
+	record, err := c.db.CreateActionToken(user.ID, purpose, email, ttl)
+	if err != nil {
+		return err
+	}
+
+	token, err := auth.GenerateActionToken(c.keys, purpose, record.ID, user.ID, record.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s%s?token=%s", c.publicURL, path, url.QueryEscape(token))
+	c.sendMail(mailer.Message{
+		To:      email,
+		Subject: subject,
+		Body:    fmt.Sprintf("%s\n\n%s\n\nOr use this token: %s\n\nThe link expires at %s.", text, link, token, record.ExpiresAt.Format(time.RFC1123)),
+	})
+
+	return nil
+}
+
+func (c *apiConfig) sendVerificationEmail(user database.User) error {
+	return c.sendActionToken(user, database.PurposeEmailVerification, user.Email, emailVerificationLifetime,
+		"Verify your Chirpy email address",
+		"Confirm this is your email address by opening the link below.",
+		"/app/verify-email")
+}
+
+// redeemActionToken verifies a token from an emailed link and marks it used.
+func (c *apiConfig) redeemActionToken(purpose, token string) (database.ActionToken, error) {
+	id, _, err := auth.ParseActionToken(c.keys, purpose, token)
+	if err != nil {
+		return database.ActionToken{}, database.ErrActionTokenInvalid
+	}
+
+	return c.db.ConsumeActionToken(id, purpose)
+}
+
+// requestPasswordReset emails a reset link. It answers the same way whether or
+// not the email belongs to an account.
+func (c *apiConfig) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil || req.Email == "" {
+		respondWithError(w, http.StatusBadRequest, "Please provide an email")
+		return
+	}
+
+	user, err := c.db.GetUserByEmail(req.Email)
+	if err == nil {
+		err = c.sendActionToken(user, database.PurposePasswordReset, user.Email, passwordResetLifetime,
+			"Reset your Chirpy password",
+			"Someone asked to reset the password of your Chirpy account. If it was you, open the link below, otherwise ignore this email.",
+			"/app/reset-password")
+		if err != nil {
+			log.Printf("Failed to issue password reset token: %s", err)
+		}
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// confirmPasswordReset sets a new password with a token from the reset email
+// and logs the account out everywhere.
+func (c *apiConfig) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+	if req.Password == "" {
+		respondWithError(w, http.StatusBadRequest, "Please provide a new password")
+		return
+	}
+
+	// check the password before redeeming, so a rejected one does not use
+	// up the link
+	_, userId, err := auth.ParseActionToken(c.keys, database.PurposePasswordReset, req.Token)
+	if err != nil {
+		respondWithActionTokenError(w, database.ErrActionTokenInvalid)
+		return
+	}
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithActionTokenError(w, database.ErrActionTokenInvalid)
+		return
+	}
+	if ok := c.validateNewPassword(w, req.Password, user.Email); !ok {
+		return
+	}
+
+	record, err := c.redeemActionToken(database.PurposePasswordReset, req.Token)
+	if err != nil {
+		respondWithActionTokenError(w, err)
+		return
+	}
+
+	hashedPassword, err := database.HashPassword(req.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
+		return
+	}
+
+	// a link sent before the account's email changed must not reset it
+	err = c.db.ResetPassword(record.UserId, record.Email, hashedPassword)
+	if err != nil {
+		respondWithActionTokenError(w, err)
+		return
+	}
+
+	_, err = c.db.RevokeAllSessions(record.UserId, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+	c.recordEvent(r, audit.Event{ActorID: record.UserId, Action: actionPasswordReset, Outcome: audit.OutcomeSuccess})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (c *apiConfig) requestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	user, err := c.db.FindUserById(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+	if user.EmailVerified {
+		respondWithError(w, http.StatusConflict, "Email is already verified")
+		return
+	}
+
+	err = c.sendVerificationEmail(user)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to send verification email")
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func (c *apiConfig) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	record, err := c.redeemActionToken(database.PurposeEmailVerification, req.Token)
+	if err != nil {
+		respondWithActionTokenError(w, err)
+		return
+	}
+
+	// the token only verifies the address it was sent to
+	err = c.db.MarkEmailVerified(record.UserId, record.Email)
+	if err != nil {
+		respondWithActionTokenError(w, err)
+		return
+	}
+
+	c.recordEvent(r, audit.Event{ActorID: record.UserId, Action: actionEmailVerify, Outcome: audit.OutcomeSuccess, Detail: record.Email})
+
+	user, err := c.db.FindUserById(record.UserId)
+	if err == nil {
+		c.bootstrapAdmin(user)
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// requestEmailChange starts moving the caller's account to a new address.
+// Nothing changes until the link mailed to the new address is opened, the
+// current address is only told about the request.
+func (c *apiConfig) requestEmailChange(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil || req.NewEmail == "" {
+		respondWithError(w, http.StatusBadRequest, "Please provide the new email")
+		return
+	}
+
+	user, err := c.db.FindUserById(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if ok := c.reauthenticate(w, r, user, req.Password); !ok {
+		return
+	}
+	if req.NewEmail == user.Email {
+		respondWithError(w, http.StatusBadRequest, "This is already your email")
+		return
+	}
+	_, err = c.db.GetUserByEmail(req.NewEmail)
+	if err == nil {
+		respondWithError(w, http.StatusConflict, database.ErrUserAlreadyExists.Error())
+		return
+	}
+
+	err = c.sendActionToken(user, database.PurposeEmailChange, req.NewEmail, emailChangeLifetime,
+		"Confirm your new Chirpy email address",
+		"Someone asked to move a Chirpy account to this email address. If it was you, open the link below to confirm.",
+		"/app/confirm-email")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to send confirmation email")
+		return
+	}
+	c.sendMail(mailer.Message{
+		To:      user.Email,
+		Subject: "Your Chirpy email address is about to change",
+		Body:    fmt.Sprintf("Someone asked to move your Chirpy account to %s. If it was not you, change your password now.", req.NewEmail),
+	})
+
+	respondWithJSON(w, http.StatusAccepted, struct{}{})
+}
+
+// confirmEmailChange completes an email change with the token mailed to the
+// new address.
+func (c *apiConfig) confirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Token string `json:"token"`
+	}
+	type Res struct {
+		ID          int    `json:"id"`
+		Email       string `json:"email"`
+		IsChirpyRed bool   `json:"is_chirpy_red"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	record, err := c.redeemActionToken(database.PurposeEmailChange, req.Token)
+	if err != nil {
+		respondWithActionTokenError(w, err)
+		return
+	}
+
+	user, err := c.db.ChangeEmail(record.UserId, record.Email)
+	if errors.Is(err, database.ErrUserAlreadyExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordEvent(r, audit.Event{ActorID: user.ID, Action: actionEmailChange, Outcome: audit.OutcomeSuccess, Detail: "changed to " + user.Email})
+	c.bootstrapAdmin(user)
+
+	respondWithJSON(w, http.StatusOK, Res{
+		ID:          user.ID,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+	})
+}
+
+func respondWithActionTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrActionTokenInvalid):
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, database.ErrActionTokenUsed), errors.Is(err, database.ErrActionTokenExpired):
+		respondWithError(w, http.StatusGone, err.Error())
+	default:
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+	}
+}
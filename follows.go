@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+func (c *apiConfig) followUser(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	followeeId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return
+	}
+
+	follow, err := c.db.Follow(userId, followeeId)
+	if errors.Is(err, database.ErrFollowSelf) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, follow)
+}
+
+func (c *apiConfig) unfollowUser(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	followeeId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return
+	}
+
+	err = c.db.Unfollow(userId, followeeId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (c *apiConfig) getFollowRequests(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	requests, err := c.db.PendingFollowRequests(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, requests)
+}
+
+func (c *apiConfig) approveFollowRequest(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	followerId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return
+	}
+
+	follow, err := c.db.ApproveFollowRequest(userId, followerId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, follow)
+}
+
+func (c *apiConfig) rejectFollowRequest(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	followerId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return
+	}
+
+	err = c.db.RejectFollowRequest(userId, followerId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (c *apiConfig) updatePrivacy(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Req struct {
+		IsPrivate bool `json:"is_private"`
+	}
+	type Res struct {
+		ID          int    `json:"id"`
+		Email       string `json:"email"`
+		IsChirpyRed bool   `json:"is_chirpy_red"`
+		IsPrivate   bool   `json:"is_private"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	user, err := c.db.SetPrivate(userId, req.IsPrivate)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{
+		ID:          user.ID,
+		Email:       user.Email,
+		IsChirpyRed: user.IsChirpyRed,
+		IsPrivate:   user.IsPrivate,
+	})
+}
@@ -0,0 +1,272 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeDenied is an attempt refused for lack of permission or because
+	// the account is blocked, as opposed to wrong credentials.
+	OutcomeDenied = "denied"
+)
+
+// Event is one entry of the audit log.
+type Event struct {
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// ActorID is the user who acted, 0 when unknown, such as a failed login
+	// for an email without an account.
+	ActorID int `json:"actor_id"`
+	// ImpersonatorID is the admin acting as ActorID, if any.
+	ImpersonatorID int    `json:"impersonator_id,omitempty"`
+	Action         string `json:"action"`
+	// TargetID is the user acted upon, when it is not the actor.
+	TargetID  int    `json:"target_id,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Outcome   string `json:"outcome"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// Filter selects events, zero values match everything.
+type Filter struct {
+	// UserID matches events where the user is the actor or the target.
+	UserID  int
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+}
+
+func (f Filter) Matches(e Event) bool {
+	switch {
+	case f.UserID != 0 && e.ActorID != f.UserID && e.TargetID != f.UserID && e.ImpersonatorID != f.UserID:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Log is an append-only JSON Lines file of events. Entries are never changed,
+// only dropped once older than the retention period by Prune.
+type Log struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewLog(path string) *Log {
+	return &Log{path: path}
+}
+
+// Record appends e to the log, setting its id and time when missing.
+func (l *Log) Record(e Event) error {
+	if e.ID == "" {
+		id, err := newEventId()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(line)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns up to limit events matching filter, newest first. A limit of
+// 0 returns every match.
+func (l *Log) Query(filter Filter, limit int) ([]Event, error) {
+	events := []Event{}
+	err := l.scan(func(e Event) error {
+		if filter.Matches(e) {
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for a, b := 0, len(events)-1; a < b; a, b = a+1, b-1 {
+		events[a], events[b] = events[b], events[a]
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+// Export writes the events matching filter to w as JSON Lines, oldest first.
+func (l *Log) Export(w io.Writer, filter Filter) error {
+	encoder := json.NewEncoder(w)
+	return l.scan(func(e Event) error {
+		if !filter.Matches(e) {
+			return nil
+		}
+		return encoder.Encode(e)
+	})
+}
+
+// Prune drops the events recorded before cutoff and returns how many were
+// dropped. The kept events are written to a new file that replaces the log,
+// so a crash midway leaves the log as it was.
+func (l *Log) Prune(cutoff time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, size, err := l.open()
+	if err != nil || f == nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	kept := [][]byte{}
+	pruned := 0
+	err = scanLines(io.LimitReader(f, size), func(line []byte, e Event) error {
+		if e.Time.Before(cutoff) {
+			pruned++
+			return nil
+		}
+		kept = append(kept, append([]byte{}, line...))
+		return nil
+	})
+	if err != nil || pruned == 0 {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	for _, line := range kept {
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Chmod(0600)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.Rename(tmp.Name(), l.path)
+	if err != nil {
+		return 0, err
+	}
+
+	return pruned, nil
+}
+
+// scan calls fn with every event recorded so far. Only finding where the log
+// ends holds mu, so reading and fn do not block Record. A concurrent Prune
+// replaces the file rather than changing it, leaving the one being read as
+// it was.
+func (l *Log) scan(fn func(e Event) error) error {
+	l.mu.Lock()
+	f, size, err := l.open()
+	l.mu.Unlock()
+	if err != nil || f == nil {
+		return err
+	}
+	defer f.Close()
+
+	return scanLines(io.LimitReader(f, size), func(_ []byte, e Event) error {
+		return fn(e)
+	})
+}
+
+// open opens the log along with its current size, or returns a nil file when
+// nothing was recorded yet. Record appends whole lines while holding mu, so
+// the first size bytes are complete events. The caller must hold mu.
+func (l *Log) open() (*os.File, int64, error) {
+	f, err := os.Open(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, info.Size(), nil
+}
+
+// scanLines calls fn with every event read from r in the order recorded.
+// Lines that cannot be decoded, such as one cut short by a crash, are
+// skipped.
+func scanLines(r io.Reader, fn func(line []byte, e Event) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := Event{}
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		err := fn(scanner.Bytes(), e)
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func newEventId() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
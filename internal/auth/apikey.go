@@ -0,0 +1,35 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix starts every personal API key, telling them apart from JWTs
+// in the Authorization header and making leaked keys easy to scan for.
+const APIKeyPrefix = "chirpy_"
+
+// GenerateAPIKey returns a new random API key. Only its hash is stored, the
+// key itself is shown to the user once.
+func GenerateAPIKey() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return APIKeyPrefix + hex.EncodeToString(bytes), nil
+}
+
+// HashAPIKey hashes key for storage. API keys carry 256 bits of entropy, so a
+// plain SHA-256 is enough and keeps lookups cheap.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
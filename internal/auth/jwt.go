@@ -3,51 +3,233 @@ package auth
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"log"
+	"errors"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-func GenerateToken(secret string, id, expiresAt int) (string, error) {
+const (
+	// Issuer is the iss claim of every token Chirpy issues.
+	Issuer = "chirpy"
+	// Audience is the aud claim of access tokens for the Chirpy API.
+	Audience = "chirpy-api"
+	// Leeway is the clock skew tolerated when checking exp, nbf and iat.
+	Leeway = 30 * time.Second
+
+	// mfaAudience is the aud claim of MFA challenge tokens, which keeps them
+	// from being accepted as access tokens.
+	mfaAudience = "chirpy-mfa"
+	mfaLifetime = 5 * time.Minute
+)
+
+var (
+	ErrTokenMalformed     = errors.New("token is malformed")
+	ErrTokenExpired       = errors.New("token has expired")
+	ErrTokenNotYetValid   = errors.New("token is not valid yet")
+	ErrTokenBadSignature  = errors.New("token signature is invalid")
+	ErrTokenInvalidClaims = errors.New("token claims are invalid")
+)
+
+// Claims are the claims of a Chirpy access token.
+type Claims struct {
+	jwt.RegisteredClaims
+	// SessionID is the session the token was issued for.
+	SessionID string `json:"sid,omitempty"`
+	// Role is the role of the user when the token was issued, for services
+	// verifying tokens with the JWKS. Chirpy itself checks the current role.
+	Role string `json:"role,omitempty"`
+	// ClientID and Scope are set on tokens issued to a third-party OAuth
+	// client, Scope is a space-separated list as in RFC 9068.
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Actor is set on impersonation tokens to the admin acting as the
+	// subject, as in RFC 8693 section 4.1.
+	Actor *Actor `json:"act,omitempty"`
+}
+
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Scopes returns the scopes the token grants. First-party tokens, which
+// carry no client id and no actor, grant every scope.
+func (c *Claims) Scopes() []string {
+	if c.ClientID == "" && c.Actor == nil {
+		return []string{ScopeAll}
+	}
+	return strings.Fields(c.Scope)
+}
+
+func GenerateToken(keys *Keyring, id, expiresAt int, sessionId, role string) (string, error) {
+	claims := newClaims(id, expiresAt, sessionId)
+	claims.Role = role
+
+	return keys.sign(claims)
+}
+
+// GenerateClientToken issues an access token to the OAuth client clientId,
+// limited to scopes.
+func GenerateClientToken(keys *Keyring, id, expiresAt int, sessionId, clientId string, scopes []string) (string, error) {
+	claims := newClaims(id, expiresAt, sessionId)
+	claims.ClientID = clientId
+	claims.Scope = strings.Join(scopes, " ")
+
+	return keys.sign(claims)
+}
+
+// GenerateImpersonationToken issues a token letting the admin actorId act as
+// user id. It is limited to scopes and belongs to no session, so it cannot be
+// refreshed.
+func GenerateImpersonationToken(keys *Keyring, id, expiresAt, actorId int, scopes []string) (string, error) {
+	claims := newClaims(id, expiresAt, "")
+	claims.Actor = &Actor{Subject: strconv.Itoa(actorId)}
+	claims.Scope = strings.Join(scopes, " ")
+
+	return keys.sign(claims)
+}
+
+// newClaims builds the claims of an access token for user id, valid for
+// expiresAt seconds and at most an hour.
+func newClaims(id, expiresAt int, sessionId string) *Claims {
 	hourInSeconds := 60 * 60
 	if expiresAt == 0 || expiresAt > hourInSeconds {
 		expiresAt = hourInSeconds
 	}
 
-	claims := &jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(expiresAt) * time.Second)),
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
-		Subject:   strconv.Itoa(id),
+	now := time.Now().UTC()
+	return &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Duration(expiresAt) * time.Second)),
+			Issuer:    Issuer,
+			Audience:  jwt.ClaimStrings{Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Subject:   strconv.Itoa(id),
+		},
+		SessionID: sessionId,
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	ss, err := token.SignedString([]byte(secret))
+// ParseToken verifies an access token and returns its claims. Failures are
+// reported as one of the ErrToken sentinel errors.
+func ParseToken(tokenString string, keys *Keyring) (*Claims, error) {
+	claims := &Claims{}
+	err := keys.parse(tokenString, Audience, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// GenerateMFAToken returns a short-lived challenge token proving that id
+// passed the password check, to be exchanged for access and refresh tokens
+// together with a second factor.
+func GenerateMFAToken(keys *Keyring, id int) (string, error) {
+	now := time.Now().UTC()
+	return keys.sign(&jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(mfaLifetime)),
+		Issuer:    Issuer,
+		Audience:  jwt.ClaimStrings{mfaAudience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Subject:   strconv.Itoa(id),
+	})
+}
 
+// ParseMFAToken verifies a challenge token and returns the user id it was
+// issued for.
+func ParseMFAToken(tokenString string, keys *Keyring) (int, error) {
+	claims := &jwt.RegisteredClaims{}
+	err := keys.parse(tokenString, mfaAudience, claims)
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, ErrTokenInvalidClaims
 	}
 
-	return ss, nil
+	return id, nil
 }
 
-func ParseToken(tokenString, secret string) (string, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
+// GenerateActionToken signs a single-use token for an emailed link. purpose
+// becomes part of the audience so a token can only be redeemed for the flow it
+// was issued for, id is the jti of the token record kept in the database.
+func GenerateActionToken(keys *Keyring, purpose, id string, userId int, expiresAt time.Time) (string, error) {
+	return keys.sign(&jwt.RegisteredClaims{
+		ID:        id,
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		Issuer:    Issuer,
+		Audience:  jwt.ClaimStrings{"chirpy-" + purpose},
+		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+		Subject:   strconv.Itoa(userId),
 	})
+}
 
+// ParseActionToken verifies a token from GenerateActionToken and returns its
+// id and user id.
+func ParseActionToken(keys *Keyring, purpose, tokenString string) (string, int, error) {
+	claims := &jwt.RegisteredClaims{}
+	err := keys.parse(tokenString, "chirpy-"+purpose, claims)
 	if err != nil {
-		return "", err
+		return "", 0, err
+	}
+
+	userId, err := strconv.Atoi(claims.Subject)
+	if err != nil || claims.ID == "" {
+		return "", 0, ErrTokenInvalidClaims
 	}
 
-	subject, err := token.Claims.GetSubject()
+	return claims.ID, userId, nil
+}
+
+// parse verifies the signature of tokenString with the key named by its kid,
+// accepting only that key's algorithm, then validates the registered claims
+// against audience. Every token must carry iss, aud, sub, exp and iat.
+func (k *Keyring) parse(tokenString, audience string, claims jwt.Claims) error {
+	_, err := jwt.ParseWithClaims(tokenString, claims, k.keyFunc,
+		jwt.WithValidMethods(k.methods()),
+		jwt.WithIssuer(Issuer),
+		jwt.WithAudience(audience),
+		jwt.WithLeeway(Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
-		log.Fatal("Unkown claims")
+		return tokenError(err)
 	}
 
-	return subject, nil
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return ErrTokenInvalidClaims
+	}
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil {
+		return ErrTokenInvalidClaims
+	}
+
+	return nil
+}
+
+// tokenError maps an error of the jwt package to our sentinel errors.
+func tokenError(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return ErrTokenMalformed
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrTokenBadSignature
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrTokenExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrTokenNotYetValid
+	default:
+		return ErrTokenInvalidClaims
+	}
 }
 
 func GenerateRefreshToken() (string, error) {
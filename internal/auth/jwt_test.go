@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestKeyring returns a keyring signing with a fresh Ed25519 key.
+func newTestKeyring(t *testing.T) *Keyring {
+	t.Helper()
+
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &Keyring{signing: key, keys: map[string]*Key{key.ID: key}}
+}
+
+// validClaims returns the claims of an access token valid right now.
+func validClaims(now time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss": Issuer,
+		"aud": []string{Audience},
+		"sub": "42",
+		"exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+	}
+}
+
+func signTestToken(t *testing.T, method jwt.SigningMethod, key any, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestParseToken(t *testing.T) {
+	keys := newTestKeyring(t)
+	now := time.Now()
+
+	// sign returns a token signed with the keyring after mutate changed the
+	// claims of a valid token.
+	sign := func(t *testing.T, mutate func(jwt.MapClaims)) string {
+		claims := validClaims(now)
+		if mutate != nil {
+			mutate(claims)
+		}
+		return signTestToken(t, keys.signing.Method, keys.signing.private, keys.signing.ID, claims)
+	}
+
+	tests := []struct {
+		name    string
+		token   func(t *testing.T) string
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			token: func(t *testing.T) string { return sign(t, nil) },
+		},
+		{
+			name: "alg confusion with the public key as HS256 secret",
+			token: func(t *testing.T) string {
+				return signTestToken(t, jwt.SigningMethodHS256, []byte(keys.signing.public.(ed25519.PublicKey)), keys.signing.ID, validClaims(now))
+			},
+			wantErr: ErrTokenBadSignature,
+		},
+		{
+			name: "wrong alg for the kid",
+			token: func(t *testing.T) string {
+				other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signTestToken(t, jwt.SigningMethodES256, other, keys.signing.ID, validClaims(now))
+			},
+			wantErr: ErrTokenBadSignature,
+		},
+		{
+			name: "alg none",
+			token: func(t *testing.T) string {
+				return signTestToken(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, keys.signing.ID, validClaims(now))
+			},
+			wantErr: ErrTokenBadSignature,
+		},
+		{
+			name: "signed with another key of the same kid",
+			token: func(t *testing.T) string {
+				_, other, err := ed25519.GenerateKey(rand.Reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return signTestToken(t, jwt.SigningMethodEdDSA, other, keys.signing.ID, validClaims(now))
+			},
+			wantErr: ErrTokenBadSignature,
+		},
+		{
+			name: "unknown kid",
+			token: func(t *testing.T) string {
+				return signTestToken(t, keys.signing.Method, keys.signing.private, "unknown", validClaims(now))
+			},
+			wantErr: ErrTokenBadSignature,
+		},
+		{
+			name:    "wrong iss",
+			token:   func(t *testing.T) string { return sign(t, func(c jwt.MapClaims) { c["iss"] = "someone-else" }) },
+			wantErr: ErrTokenInvalidClaims,
+		},
+		{
+			name:    "wrong aud",
+			token:   func(t *testing.T) string { return sign(t, func(c jwt.MapClaims) { c["aud"] = []string{mfaAudience} }) },
+			wantErr: ErrTokenInvalidClaims,
+		},
+		{
+			name:    "missing sub",
+			token:   func(t *testing.T) string { return sign(t, func(c jwt.MapClaims) { delete(c, "sub") }) },
+			wantErr: ErrTokenInvalidClaims,
+		},
+		{
+			name:    "missing exp",
+			token:   func(t *testing.T) string { return sign(t, func(c jwt.MapClaims) { delete(c, "exp") }) },
+			wantErr: ErrTokenInvalidClaims,
+		},
+		{
+			name:    "missing iat",
+			token:   func(t *testing.T) string { return sign(t, func(c jwt.MapClaims) { delete(c, "iat") }) },
+			wantErr: ErrTokenInvalidClaims,
+		},
+		{
+			name: "expired",
+			token: func(t *testing.T) string {
+				return sign(t, func(c jwt.MapClaims) { c["exp"] = now.Add(-time.Minute).Unix() })
+			},
+			wantErr: ErrTokenExpired,
+		},
+		{
+			name: "expired within leeway",
+			token: func(t *testing.T) string {
+				return sign(t, func(c jwt.MapClaims) { c["exp"] = now.Add(-10 * time.Second).Unix() })
+			},
+		},
+		{
+			name: "nbf in the future",
+			token: func(t *testing.T) string {
+				return sign(t, func(c jwt.MapClaims) { c["nbf"] = now.Add(time.Minute).Unix() })
+			},
+			wantErr: ErrTokenNotYetValid,
+		},
+		{
+			name: "iat within leeway",
+			token: func(t *testing.T) string {
+				return sign(t, func(c jwt.MapClaims) { c["iat"] = now.Add(10 * time.Second).Unix() })
+			},
+		},
+		{
+			name: "iat beyond leeway",
+			token: func(t *testing.T) string {
+				return sign(t, func(c jwt.MapClaims) { c["iat"] = now.Add(Leeway + time.Minute).Unix() })
+			},
+			wantErr: ErrTokenNotYetValid,
+		},
+		{
+			name:    "malformed",
+			token:   func(t *testing.T) string { return "not-a-jwt" },
+			wantErr: ErrTokenMalformed,
+		},
+		{
+			name:    "malformed segments",
+			token:   func(t *testing.T) string { return "a.b.c" },
+			wantErr: ErrTokenMalformed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseToken(tt.token(t), keys)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("ParseToken() error = %v, want nil", err)
+				}
+				if claims.Subject != "42" {
+					t.Errorf("ParseToken() subject = %q, want %q", claims.Subject, "42")
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTokenHMAC(t *testing.T) {
+	keys := NewHMACKeyring("secret")
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		key     []byte
+		wantErr error
+	}{
+		{name: "valid", key: []byte("secret")},
+		{name: "wrong secret", key: []byte("other"), wantErr: ErrTokenBadSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := signTestToken(t, jwt.SigningMethodHS256, tt.key, "", validClaims(now))
+			_, err := ParseToken(token, keys)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseMFATokenRejectsAccessToken(t *testing.T) {
+	keys := newTestKeyring(t)
+
+	token, err := GenerateToken(keys, 42, 0, "session", RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseMFAToken(token, keys)
+	if !errors.Is(err, ErrTokenInvalidClaims) {
+		t.Fatalf("ParseMFAToken() error = %v, want %v", err, ErrTokenInvalidClaims)
+	}
+}
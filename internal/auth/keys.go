@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	ErrUnsupportedKey = errors.New("unsupported key type, expected an Ed25519, P-256 or RSA key")
+	ErrUnknownKey     = errors.New("token was signed with an unknown key")
+)
+
+// Key is a key used to sign or verify tokens, identified by its kid.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// private is nil for verification-only keys.
+	private crypto.PrivateKey
+	public  crypto.PublicKey
+}
+
+// Keyring holds the key tokens are signed with and every key tokens are
+// still accepted from, so keys can be rotated without logging everyone out.
+type Keyring struct {
+	signing *Key
+	keys    map[string]*Key
+}
+
+// NewHMACKeyring returns a keyring that signs and verifies with a shared
+// HS256 secret.
+func NewHMACKeyring(secret string) *Keyring {
+	key := &Key{Method: jwt.SigningMethodHS256, private: []byte(secret), public: []byte(secret)}
+	return &Keyring{signing: key, keys: map[string]*Key{"": key}}
+}
+
+// LoadKeyring signs with the private key in the PEM file at signingPath and
+// additionally accepts tokens signed by the keys at verificationPaths, which
+// may hold public or private keys. A non-empty hmacSecret keeps HS256 tokens
+// without a kid valid while clients migrate.
+func LoadKeyring(signingPath string, verificationPaths []string, hmacSecret string) (*Keyring, error) {
+	data, err := os.ReadFile(signingPath)
+	if err != nil {
+		return nil, err
+	}
+
+	signing, err := ParseKeyPEM(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", signingPath, err)
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingPath)
+	}
+
+	keyring := &Keyring{signing: signing, keys: map[string]*Key{signing.ID: signing}}
+	for _, path := range verificationPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := ParseKeyPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keyring.keys[key.ID] = key
+	}
+
+	if hmacSecret != "" {
+		keyring.keys[""] = &Key{Method: jwt.SigningMethodHS256, public: []byte(hmacSecret)}
+	}
+
+	return keyring, nil
+}
+
+// ParseKeyPEM parses a PKCS#8, PKCS#1 or SEC 1 private key, or a PKIX public
+// key. The kid is the RFC 7638 thumbprint of the public key.
+func ParseKeyPEM(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var parsed any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		parsed, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.Method, key.private, key.public = jwt.SigningMethodEdDSA, k, k.Public()
+	case *ecdsa.PrivateKey:
+		key.Method, key.private, key.public = jwt.SigningMethodES256, k, &k.PublicKey
+	case *rsa.PrivateKey:
+		key.Method, key.private, key.public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case ed25519.PublicKey:
+		key.Method, key.public = jwt.SigningMethodEdDSA, k
+	case *ecdsa.PublicKey:
+		key.Method, key.public = jwt.SigningMethodES256, k
+	case *rsa.PublicKey:
+		key.Method, key.public = jwt.SigningMethodRS256, k
+	default:
+		return nil, ErrUnsupportedKey
+	}
+
+	if ec, ok := key.public.(*ecdsa.PublicKey); ok && ec.Curve != elliptic.P256() {
+		return nil, ErrUnsupportedKey
+	}
+
+	jwk, err := publicJWK(key)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = jwk.thumbprint()
+
+	return key, nil
+}
+
+// sign signs claims with the signing key, stamping its kid in the header.
+func (k *Keyring) sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	if k.signing.ID != "" {
+		token.Header["kid"] = k.signing.ID
+	}
+
+	return token.SignedString(k.signing.private)
+}
+
+// keyFunc picks the verification key named by the kid header of a token and
+// refuses tokens signed with any algorithm other than that key's.
+func (k *Keyring) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if t.Method.Alg() != key.Method.Alg() {
+		return nil, jwt.ErrTokenSignatureInvalid
+	}
+
+	return key.public, nil
+}
+
+// methods lists the algorithms of the verification keys.
+func (k *Keyring) methods() []string {
+	methods := []string{}
+	for _, key := range k.keys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the keyring. Shared HMAC secrets are never
+// published.
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.keys {
+		jwk, err := publicJWK(key)
+		if err != nil {
+			continue
+		}
+		jwk.Use = "sig"
+		jwk.Alg = key.Method.Alg()
+		jwk.Kid = key.ID
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	return set
+}
+
+func publicJWK(key *Key) (JWK, error) {
+	enc := base64.RawURLEncoding
+	switch pub := key.public.(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: enc.EncodeToString(pub)}, nil
+	case *ecdsa.PublicKey:
+		return JWK{
+			Kty: "EC",
+			Crv: "P-256",
+			X:   enc.EncodeToString(pub.X.FillBytes(make([]byte, 32))),
+			Y:   enc.EncodeToString(pub.Y.FillBytes(make([]byte, 32))),
+		}, nil
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			N:   enc.EncodeToString(pub.N.Bytes()),
+			E:   enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}, nil
+	default:
+		return JWK{}, ErrUnsupportedKey
+	}
+}
+
+// PublicKey decodes the public key of an OKP, EC or RSA JWK, such as the keys
+// an OpenID provider publishes.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	enc := base64.RawURLEncoding
+	switch j.Kty {
+	case "OKP":
+		x, err := enc.DecodeString(j.X)
+		if err != nil || j.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return ed25519.PublicKey(x), nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[j.Crv]
+		if !ok {
+			return nil, ErrUnsupportedKey
+		}
+		x, errX := enc.DecodeString(j.X)
+		y, errY := enc.DecodeString(j.Y)
+		if errX != nil || errY != nil {
+			return nil, ErrUnsupportedKey
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrUnsupportedKey
+		}
+		return pub, nil
+	case "RSA":
+		n, errN := enc.DecodeString(j.N)
+		e, errE := enc.DecodeString(j.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, ErrUnsupportedKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	default:
+		return nil, ErrUnsupportedKey
+	}
+}
+
+// thumbprint computes the RFC 7638 thumbprint over the required members of
+// the key, which encoding/json already emits in lexicographic order.
+func (j JWK) thumbprint() string {
+	var members any
+	switch j.Kty {
+	case "OKP":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{j.Crv, j.Kty, j.X}
+	case "EC":
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{j.Crv, j.Kty, j.X, j.Y}
+	default:
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{j.E, j.Kty, j.N}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// PKCEMethodS256 is the only code challenge method accepted, "plain" offers
+// no protection once the authorization request leaks.
+const PKCEMethodS256 = "S256"
+
+// GenerateClientCredentials returns the id and secret of a new OAuth client.
+// Only the hash of the secret is stored.
+func GenerateClientCredentials() (string, string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", "", err
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(id), base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+func HashClientSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckClientSecret compares secret against a hash from HashClientSecret in
+// constant time.
+func CheckClientSecret(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashClientSecret(secret)), []byte(hash)) == 1
+}
+
+// GenerateAuthorizationCode returns a new single-use authorization code.
+func GenerateAuthorizationCode() (string, error) {
+	return GenerateRefreshToken()
+}
+
+// ValidCodeVerifier reports whether verifier has the length and characters
+// RFC 7636 requires.
+func ValidCodeVerifier(verifier string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	for _, c := range verifier {
+		if !(c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~') {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyPKCE checks a code verifier against the S256 code challenge sent with
+// the authorization request.
+func VerifyPKCE(verifier, challenge string) bool {
+	if !ValidCodeVerifier(verifier) {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
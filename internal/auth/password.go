@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrPasswordTooShort      = errors.New("password is too short")
+	ErrPasswordTooLong       = errors.New("password is too long")
+	ErrPasswordBreached      = errors.New("password appears in a list of breached passwords")
+	ErrPasswordContainsEmail = errors.New("password must not contain your email address")
+)
+
+// PasswordPolicy decides which new passwords are acceptable. It is not applied
+// to existing passwords at login.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	breached  map[string]struct{}
+}
+
+// NewPasswordPolicy builds a policy, loading the breached passwords from
+// breachedListPath, one per line, when it is not empty.
+func NewPasswordPolicy(minLength, maxLength int, breachedListPath string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{MinLength: minLength, MaxLength: maxLength, breached: map[string]struct{}{}}
+	if breachedListPath == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(breachedListPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			policy.breached[line] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// Validate checks password, chosen by the owner of email, against the policy.
+func (p *PasswordPolicy) Validate(password, email string) error {
+	if len([]rune(password)) < p.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters long", ErrPasswordTooShort, p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Errorf("%w: it must be at most %d bytes long", ErrPasswordTooLong, p.MaxLength)
+	}
+
+	lower := strings.ToLower(password)
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if email != "" && (lower == strings.ToLower(email) || (len(local) >= 3 && strings.Contains(lower, local))) {
+		return ErrPasswordContainsEmail
+	}
+
+	if _, ok := p.breached[password]; ok {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package auth
+
+import "context"
+
+const (
+	TierFree = "free"
+	TierRed  = "red"
+)
+
+// ScopeAll grants every scope, it is held by first-party access tokens.
+// Endpoints that manage the account itself require it, so they cannot be
+// reached with an API key.
+const ScopeAll = "*"
+
+const (
+	ScopeChirpsRead   = "chirps:read"
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+)
+
+// GrantableScopes are the scopes an API key can be given.
+var GrantableScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead, ScopeProfileWrite}
+
+func ValidScope(scope string) bool {
+	for _, s := range GrantableScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID int
+	Tier   string
+	Role   string
+	Scopes []string
+	// SessionID is the session the credentials were issued for, if any.
+	SessionID string
+	// ClientID is the OAuth client acting for the user, if any.
+	ClientID      string
+	EmailVerified bool
+	// ImpersonatorID is the admin acting as the user, if any.
+	ImpersonatorID int
+}
+
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasPermission reports whether the caller's role grants permission. Roles
+// only apply to first-party credentials, never to API keys or OAuth clients.
+func (p Principal) HasPermission(permission string) bool {
+	return p.HasScope(ScopeAll) && RoleHasPermission(p.Role, permission)
+}
+
+type principalKey struct{}
+
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the principal stored by WithPrincipal, ok is
+// false for unauthenticated requests.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
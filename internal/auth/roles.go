@@ -0,0 +1,53 @@
+package auth
+
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+const (
+	PermViewMetrics    = "metrics:view"
+	PermResetMetrics   = "metrics:reset"
+	PermManageLockouts = "lockouts:manage"
+	PermModerateChirps = "chirps:moderate"
+	PermManageRoles    = "roles:manage"
+	PermManageUsers    = "users:manage"
+	PermImpersonate    = "users:impersonate"
+	PermViewAudit      = "audit:view"
+	PermManageWebhooks = "webhooks:manage"
+)
+
+// rolePermissions lists what each role may do beyond what every user can.
+// Admins hold every permission of moderators.
+var rolePermissions = map[string][]string{
+	RoleUser:      {},
+	RoleModerator: {PermModerateChirps},
+	RoleAdmin: {
+		PermModerateChirps,
+		PermViewMetrics,
+		PermResetMetrics,
+		PermManageLockouts,
+		PermManageRoles,
+		PermManageUsers,
+		PermImpersonate,
+		PermViewAudit,
+		PermManageWebhooks,
+	},
+}
+
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether role grants permission. Unknown roles
+// grant nothing.
+func RoleHasPermission(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
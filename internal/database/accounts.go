@@ -0,0 +1,207 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// nextUserId returns the id for a new user. Ids are never reused, so data
+// that outlives a deleted account cannot be attributed to a new one.
+func (f *File) nextUserId() int {
+	for _, v := range f.Users {
+		if v.ID > f.LastUserId {
+			f.LastUserId = v.ID
+		}
+	}
+	f.LastUserId++
+	return f.LastUserId
+}
+
+// DeleteUser deletes the user with the given id and everything tied to the
+// account: follows, sessions and refresh tokens, API keys, OAuth clients,
+// linked identities and pending email tokens. With anonymize set the public
+// chirps of the user are kept without an author, all other chirps are
+// deleted.
+func (db *DB) DeleteUser(id int, anonymize bool) error {
+	return db.update(func(file *File) error {
+		user, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+		delete(file.Users, user.Email)
+
+		for chirpId, chirp := range file.Chirps {
+			if chirp.AuthorId != id {
+				chirp.Mentions = removeId(chirp.Mentions, id)
+				file.Chirps[chirpId] = chirp
+				continue
+			}
+			if anonymize && chirp.Visibility == VisibilityPublic && !chirp.IsDeleted() {
+				chirp.AuthorId = 0
+				file.Chirps[chirpId] = chirp
+				continue
+			}
+			delete(file.Chirps, chirpId)
+			for _, daily := range file.ChirpViews {
+				delete(daily, chirpId)
+			}
+		}
+
+		for k, v := range file.Follows {
+			if v.FollowerId == id || v.FolloweeId == id {
+				delete(file.Follows, k)
+			}
+		}
+		for k, v := range file.Sessions {
+			if v.UserId == id {
+				file.revokeSession(k)
+			}
+		}
+		for k, v := range file.Tokens {
+			if v.ID == id {
+				delete(file.Tokens, k)
+			}
+		}
+		for k, v := range file.APIKeys {
+			if v.UserId == id {
+				delete(file.APIKeys, k)
+			}
+		}
+		for k, v := range file.OAuthClients {
+			if v.OwnerId != id {
+				continue
+			}
+			delete(file.OAuthClients, k)
+			for sessionId, session := range file.Sessions {
+				if session.ClientId == k {
+					file.revokeSession(sessionId)
+				}
+			}
+		}
+		for k, v := range file.AuthorizationCodes {
+			if v.UserId == id {
+				delete(file.AuthorizationCodes, k)
+			}
+		}
+		for k, v := range file.Identities {
+			if v.UserId == id {
+				delete(file.Identities, k)
+			}
+		}
+		for k, v := range file.ActionTokens {
+			if v.UserId == id {
+				delete(file.ActionTokens, k)
+			}
+		}
+		return nil
+	})
+}
+
+func removeId(ids []int, id int) []int {
+	kept := []int{}
+	for _, v := range ids {
+		if v != id {
+			kept = append(kept, v)
+		}
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
+
+// UserExport is everything stored about a user, for data portability
+// requests. Secrets such as the password hash are left out.
+type UserExport struct {
+	Profile      ExportedProfile `json:"profile"`
+	Chirps       []Chirp         `json:"chirps"`
+	Following    []Follow        `json:"following"`
+	Followers    []Follow        `json:"followers"`
+	Sessions     []Session       `json:"sessions"`
+	APIKeys      []APIKey        `json:"api_keys"`
+	OAuthClients []OAuthClient   `json:"oauth_clients"`
+	Identities   []Identity      `json:"identities"`
+}
+
+type ExportedProfile struct {
+	ID             int    `json:"id"`
+	Email          string `json:"email"`
+	IsChirpyRed    bool   `json:"is_chirpy_red"`
+	IsPrivate      bool   `json:"is_private"`
+	EmailVerified  bool   `json:"email_verified"`
+	SensitiveMedia string `json:"sensitive_media"`
+	TOTPEnabled    bool   `json:"totp_enabled"`
+	// Subscription is the user's Chirpy Red subscription, if any.
+	Subscription *Subscription `json:"subscription,omitempty"`
+	ExportedAt   time.Time     `json:"exported_at"`
+}
+
+func (db *DB) ExportUser(id int) (UserExport, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	user, ok := file.UserById(id)
+	if !ok {
+		return UserExport{}, errors.New("User does not exist")
+	}
+
+	export := UserExport{
+		Profile: ExportedProfile{
+			ID:             user.ID,
+			Email:          user.Email,
+			IsChirpyRed:    user.IsChirpyRed,
+			IsPrivate:      user.IsPrivate,
+			EmailVerified:  user.EmailVerified,
+			SensitiveMedia: user.SensitiveMedia,
+			TOTPEnabled:    user.TOTPEnabled,
+			Subscription:   user.Subscription,
+			ExportedAt:     time.Now().UTC(),
+		},
+		Chirps:       []Chirp{},
+		Following:    []Follow{},
+		Followers:    []Follow{},
+		Sessions:     []Session{},
+		APIKeys:      []APIKey{},
+		OAuthClients: []OAuthClient{},
+		Identities:   []Identity{},
+	}
+	for _, v := range file.Chirps {
+		if v.AuthorId == id {
+			export.Chirps = append(export.Chirps, v)
+		}
+	}
+	for _, v := range file.Follows {
+		if v.FollowerId == id {
+			export.Following = append(export.Following, v)
+		}
+		if v.FolloweeId == id {
+			export.Followers = append(export.Followers, v)
+		}
+	}
+	for _, v := range file.Sessions {
+		if v.UserId == id {
+			export.Sessions = append(export.Sessions, v)
+		}
+	}
+	for _, v := range file.APIKeys {
+		if v.UserId == id {
+			v.Hash = ""
+			export.APIKeys = append(export.APIKeys, v)
+		}
+	}
+	for _, v := range file.OAuthClients {
+		if v.OwnerId == id {
+			v.SecretHash = ""
+			export.OAuthClients = append(export.OAuthClients, v)
+		}
+	}
+	for _, v := range file.Identities {
+		if v.UserId == id {
+			export.Identities = append(export.Identities, v)
+		}
+	}
+
+	return export, nil
+}
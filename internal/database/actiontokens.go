@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	PurposePasswordReset     = "password-reset"
+	PurposeEmailVerification = "email-verification"
+	PurposeEmailChange       = "email-change"
+)
+
+var (
+	ErrActionTokenInvalid = errors.New("Token is invalid")
+	ErrActionTokenUsed    = errors.New("Token has already been used")
+	ErrActionTokenExpired = errors.New("Token has expired")
+)
+
+// ActionToken records a single-use token sent by email, such as a password
+// reset link. Email is the address the token was sent to.
+type ActionToken struct {
+	ID        string     `json:"id"`
+	UserId    int        `json:"user_id"`
+	Purpose   string     `json:"purpose"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+}
+
+// CreateActionToken records a new token for userId, invalidating any unused
+// token of the same purpose issued before it.
+func (db *DB) CreateActionToken(userId int, purpose, email string, ttl time.Duration) (ActionToken, error) {
+	id, err := newFamilyId()
+	if err != nil {
+		return ActionToken{}, err
+	}
+
+	now := time.Now().UTC()
+	token := ActionToken{
+		ID:        id,
+		UserId:    userId,
+		Purpose:   purpose,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	err = db.update(func(file *File) error {
+		file.pruneActionTokens(now)
+		for k, v := range file.ActionTokens {
+			if v.UserId == userId && v.Purpose == purpose && v.UsedAt == nil {
+				delete(file.ActionTokens, k)
+			}
+		}
+		file.ActionTokens[id] = token
+		return nil
+	})
+	if err != nil {
+		return ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+// ConsumeActionToken marks the token as used so it cannot be redeemed twice.
+func (db *DB) ConsumeActionToken(id, purpose string) (ActionToken, error) {
+	token := ActionToken{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.ActionTokens[id]
+		if !ok || existing.Purpose != purpose {
+			return ErrActionTokenInvalid
+		}
+		if existing.UsedAt != nil {
+			return ErrActionTokenUsed
+		}
+		now := time.Now().UTC()
+		if existing.ExpiresAt.Before(now) {
+			return ErrActionTokenExpired
+		}
+
+		existing.UsedAt = &now
+		file.ActionTokens[id] = existing
+		file.pruneActionTokens(now)
+		token = existing
+		return nil
+	})
+	if err != nil {
+		return ActionToken{}, err
+	}
+
+	return token, nil
+}
+
+// pruneActionTokens drops the records of tokens that expired before now.
+// Used tokens are kept until then, so redeeming one twice is still reported
+// as such.
+func (f *File) pruneActionTokens(now time.Time) {
+	for k, v := range f.ActionTokens {
+		if v.ExpiresAt.Before(now) {
+			delete(f.ActionTokens, k)
+		}
+	}
+}
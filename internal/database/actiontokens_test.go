@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCreateActionTokenPrunesExpired(t *testing.T) {
+	db := newTestDB(t)
+
+	expired, err := db.CreateActionToken(1, PurposePasswordReset, "a@example.com", -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := db.CreateActionToken(2, PurposeEmailVerification, "b@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ConsumeActionToken(used.ID, PurposeEmailVerification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.CreateActionToken(3, PurposePasswordReset, "c@example.com", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := db.ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := file.ActionTokens[expired.ID]; ok {
+		t.Errorf("expired token %s was kept", expired.ID)
+	}
+	// a used token is kept until it expires to report reuse
+	_, err = db.ConsumeActionToken(used.ID, PurposeEmailVerification)
+	if !errors.Is(err, ErrActionTokenUsed) {
+		t.Errorf("ConsumeActionToken() error = %v, want %v", err, ErrActionTokenUsed)
+	}
+}
+
+func TestResetPasswordRequiresCurrentEmail(t *testing.T) {
+	db := newTestDB(t)
+
+	user, err := db.CreateUser("old@example.com", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err = db.ChangeEmail(user.ID, "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.ResetPassword(user.ID, "old@example.com", "stale")
+	if !errors.Is(err, ErrActionTokenInvalid) {
+		t.Fatalf("ResetPassword() error = %v, want %v", err, ErrActionTokenInvalid)
+	}
+	err = db.ResetPassword(user.ID, "new@example.com", "fresh")
+	if err != nil {
+		t.Fatalf("ResetPassword() error = %v, want nil", err)
+	}
+
+	user, err = db.FindUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Password != "fresh" {
+		t.Errorf("password = %q, want %q", user.Password, "fresh")
+	}
+}
@@ -0,0 +1,164 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUserSuspended    = errors.New("User is suspended")
+	ErrUserNotSuspended = errors.New("User is not suspended")
+)
+
+// UserActivity counts what a user has created, for support and moderation.
+type UserActivity struct {
+	Chirps        int `json:"chirps"`
+	DeletedChirps int `json:"deleted_chirps"`
+	Followers     int `json:"followers"`
+	Following     int `json:"following"`
+}
+
+// SearchUsers returns the page of users whose email contains query, or whose
+// id is query, ordered by id, along with the total number of matches. An
+// empty query matches everyone.
+func (db *DB) SearchUsers(query string, offset, limit int) ([]User, int, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = strings.ToLower(strings.TrimSpace(query))
+	users := []User{}
+	for _, v := range file.Users {
+		if query == "" || strings.Contains(strings.ToLower(v.Email), query) || strconv.Itoa(v.ID) == query {
+			users = append(users, v)
+		}
+	}
+	sort.Slice(users, func(a, b int) bool {
+		return users[a].ID < users[b].ID
+	})
+
+	total := len(users)
+	if offset >= total {
+		return []User{}, total, nil
+	}
+	return users[offset:min(offset+limit, total)], total, nil
+}
+
+func (db *DB) GetUserActivity(id int) (UserActivity, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return UserActivity{}, err
+	}
+
+	activity := UserActivity{}
+	for _, v := range file.Chirps {
+		if v.AuthorId != id {
+			continue
+		}
+		if v.IsDeleted() {
+			activity.DeletedChirps++
+		} else {
+			activity.Chirps++
+		}
+	}
+	for _, v := range file.Follows {
+		if v.Status != FollowAccepted {
+			continue
+		}
+		if v.FolloweeId == id {
+			activity.Followers++
+		}
+		if v.FollowerId == id {
+			activity.Following++
+		}
+	}
+
+	return activity, nil
+}
+
+// SuspendUser suspends the user and revokes all of their sessions. Their API
+// keys are kept but refused until the user is unsuspended.
+func (db *DB) SuspendUser(id int, reason string) (User, error) {
+	user := User{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+		if existing.SuspendedAt != nil {
+			return ErrUserSuspended
+		}
+
+		now := time.Now().UTC()
+		existing.SuspendedAt = &now
+		existing.SuspensionReason = reason
+		file.Users[existing.Email] = existing
+		file.revokeUserSessions(id)
+		user = existing
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (db *DB) UnsuspendUser(id int) (User, error) {
+	user := User{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+		if existing.SuspendedAt == nil {
+			return ErrUserNotSuspended
+		}
+
+		existing.SuspendedAt = nil
+		existing.SuspensionReason = ""
+		file.Users[existing.Email] = existing
+		user = existing
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// RequirePasswordReset logs the user out everywhere and blocks password
+// logins until a new password is set.
+func (db *DB) RequirePasswordReset(id int) error {
+	return db.update(func(file *File) error {
+		user, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+
+		user.PasswordResetRequired = true
+		file.Users[user.Email] = user
+		file.revokeUserSessions(id)
+		return nil
+	})
+}
+
+// revokeUserSessions revokes every session of the user, including those of
+// OAuth clients, and the authorization codes not yet redeemed.
+func (f *File) revokeUserSessions(id int) {
+	for k, v := range f.Sessions {
+		if v.UserId == id {
+			f.revokeSession(k)
+		}
+	}
+	for k, v := range f.AuthorizationCodes {
+		if v.UserId == id {
+			delete(f.AuthorizationCodes, k)
+		}
+	}
+}
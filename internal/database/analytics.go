@@ -0,0 +1,103 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+const DateLayout = "2006-01-02"
+
+type DailyStats struct {
+	Date         string `json:"date"`
+	Views        int    `json:"views"`
+	NewFollowers int    `json:"new_followers"`
+}
+
+type ChirpStats struct {
+	ChirpId int `json:"chirp_id"`
+	Views   int `json:"views"`
+}
+
+type Analytics struct {
+	Days      []DailyStats
+	Chirps    []ChirpStats
+	Followers int
+}
+
+// RecordChirpViews adds counts, keyed by chirp id, to the totals of each chirp
+// and to the daily counts for day. Views of chirps purged in the meantime are
+// dropped.
+func (db *DB) RecordChirpViews(day time.Time, counts map[int]int) error {
+	return db.update(func(file *File) error {
+		date := day.UTC().Format(DateLayout)
+		daily, ok := file.ChirpViews[date]
+		if !ok {
+			daily = map[int]int{}
+			file.ChirpViews[date] = daily
+		}
+
+		for id, count := range counts {
+			chirp, ok := file.Chirps[id]
+			if !ok {
+				continue
+			}
+			chirp.Views += count
+			file.Chirps[id] = chirp
+			daily[id] += count
+		}
+		return nil
+	})
+}
+
+// AuthorAnalytics aggregates the views and follower growth of authorId for
+// every day from from to to, both inclusive.
+func (db *DB) AuthorAnalytics(authorId int, from, to time.Time) (Analytics, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return Analytics{}, err
+	}
+
+	analytics := Analytics{Days: []DailyStats{}, Chirps: []ChirpStats{}}
+	dayIndex := map[string]int{}
+	for day := from.UTC(); !day.After(to.UTC()); day = day.AddDate(0, 0, 1) {
+		date := day.Format(DateLayout)
+		dayIndex[date] = len(analytics.Days)
+		analytics.Days = append(analytics.Days, DailyStats{Date: date})
+	}
+
+	chirpViews := map[int]int{}
+	for date, counts := range file.ChirpViews {
+		i, ok := dayIndex[date]
+		if !ok {
+			continue
+		}
+		for id, count := range counts {
+			if chirp, ok := file.Chirps[id]; ok && chirp.AuthorId == authorId {
+				analytics.Days[i].Views += count
+				chirpViews[id] += count
+			}
+		}
+	}
+
+	for _, v := range file.Follows {
+		if v.FolloweeId != authorId || v.Status != FollowAccepted {
+			continue
+		}
+		analytics.Followers++
+		if v.AcceptedAt == nil {
+			continue
+		}
+		if i, ok := dayIndex[v.AcceptedAt.UTC().Format(DateLayout)]; ok {
+			analytics.Days[i].NewFollowers++
+		}
+	}
+
+	for id, views := range chirpViews {
+		analytics.Chirps = append(analytics.Chirps, ChirpStats{ChirpId: id, Views: views})
+	}
+	sort.Slice(analytics.Chirps, func(a, b int) bool {
+		return analytics.Chirps[a].Views > analytics.Chirps[b].Views
+	})
+
+	return analytics, nil
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrAPIKeyExpired  = errors.New("API key expired")
+)
+
+// apiKeyUsageResolution is how stale LastUsedAt may get before a request
+// with the key writes it again.
+const apiKeyUsageResolution = time.Minute
+
+// APIKey is a named, scoped credential a user created for a bot or an
+// integration. Only the hash of the key is stored, Prefix is kept so users
+// can tell their keys apart.
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserId     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Hash       string     `json:"hash"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// CreateAPIKey stores a key with the given hash for userId. A nil expiresAt
+// creates a key that does not expire.
+func (db *DB) CreateAPIKey(userId int, name, hash, prefix string, scopes []string, expiresAt *time.Time) (APIKey, error) {
+	id, err := newFamilyId()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key := APIKey{
+		ID:        id,
+		UserId:    userId,
+		Name:      name,
+		Hash:      hash,
+		Prefix:    prefix,
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+	err = db.update(func(file *File) error {
+		file.APIKeys[id] = key
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+// LookupAPIKey finds the key with the given hash and records that it was used.
+func (db *DB) LookupAPIKey(hash string) (APIKey, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	key, ok := APIKey{}, false
+	for _, v := range file.APIKeys {
+		if v.Hash == hash {
+			key, ok = v, true
+			break
+		}
+	}
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	now := time.Now().UTC()
+	if key.ExpiresAt != nil && key.ExpiresAt.Before(now) {
+		return APIKey{}, ErrAPIKeyExpired
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyUsageResolution {
+		key.LastUsedAt = &now
+		err = db.update(func(file *File) error {
+			if _, ok := file.APIKeys[key.ID]; !ok {
+				return ErrAPIKeyNotFound
+			}
+			file.APIKeys[key.ID] = key
+			return nil
+		})
+		if err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns the keys of userId, newest first.
+func (db *DB) ListAPIKeys(userId int) ([]APIKey, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []APIKey{}
+	for _, v := range file.APIKeys {
+		if v.UserId == userId {
+			keys = append(keys, v)
+		}
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return keys[a].CreatedAt.After(keys[b].CreatedAt)
+	})
+
+	return keys, nil
+}
+
+func (db *DB) RevokeAPIKey(userId int, id string) error {
+	return db.update(func(file *File) error {
+		key, ok := file.APIKeys[id]
+		if !ok || key.UserId != userId {
+			return ErrAPIKeyNotFound
+		}
+		delete(file.APIKeys, id)
+		return nil
+	})
+}
@@ -1,11 +1,68 @@
 package database
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmArgon2id = "argon2id"
+)
+
+var ErrPasswordMismatch = errors.New("Passwords do not match")
+
+// Argon2Params are the Argon2id cost parameters, Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommended option of RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+// PasswordHasher hashes new passwords with Algorithm. Hashes made with another
+// algorithm or other parameters still verify, but NeedsRehash reports them.
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+var hasher = PasswordHasher{
+	Algorithm:  AlgorithmBcrypt,
+	BcryptCost: bcrypt.DefaultCost,
+	Argon2:     DefaultArgon2Params,
+}
+
+// SetPasswordHasher configures how HashPassword hashes passwords. It must be
+// called before the server starts handling requests.
+func SetPasswordHasher(h PasswordHasher) {
+	hasher = h
+}
+
 func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if hasher.Algorithm == AlgorithmArgon2id {
+		return hashArgon2id(password, hasher.Argon2)
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hasher.BcryptCost)
 	if err != nil {
 		return "", err
 	}
@@ -13,7 +70,12 @@ func HashPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
+// ComparePassword checks password against a bcrypt or Argon2id hash.
 func ComparePassword(password string, passwordToCompare string) error {
+	if strings.HasPrefix(passwordToCompare, "$argon2id$") {
+		return compareArgon2id(password, passwordToCompare)
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(passwordToCompare), []byte(password))
 	if err != nil {
 		return err
@@ -21,3 +83,84 @@ func ComparePassword(password string, passwordToCompare string) error {
 
 	return nil
 }
+
+// NeedsRehash reports whether hash was made with another algorithm or
+// weaker parameters than the configured hasher would use today.
+func NeedsRehash(hash string) bool {
+	if hasher.Algorithm == AlgorithmArgon2id {
+		params, _, _, err := decodeArgon2id(hash)
+		return err != nil || params != hasher.Argon2
+	}
+
+	if strings.HasPrefix(hash, "$argon2id$") {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < hasher.BcryptCost
+}
+
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func compareArgon2id(password, hash string) error {
+	params, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// decodeArgon2id parses the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>.
+func decodeArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	errInvalid := errors.New("Invalid argon2id hash")
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return Argon2Params{}, nil, nil, errInvalid
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return Argon2Params{}, nil, nil, errInvalid
+	}
+
+	params := Argon2Params{}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return Argon2Params{}, nil, nil, errInvalid
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errInvalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2Params{}, nil, nil, errInvalid
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,58 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotChirpAuthor = errors.New("You are not allowed to delete this chirp")
+	ErrBatchAborted   = errors.New("Batch aborted because an operation failed")
+)
+
+// ChirpOp is a single operation of a batch, either a chirp to create or the
+// id of a chirp to delete.
+type ChirpOp struct {
+	Create *Chirp
+	Delete int
+}
+
+// ApplyChirpOps applies ops on behalf of authorId in one database write and
+// returns the outcome of each op. Created chirps are given their id in place.
+// Failed ops are skipped unless atomic is set, in which case nothing is
+// written and ErrBatchAborted is returned.
+func (db *DB) ApplyChirpOps(authorId int, ops []ChirpOp, atomic bool) ([]error, error) {
+	results := make([]error, len(ops))
+	err := db.update(func(file *File) error {
+		now := time.Now().UTC()
+		failed := false
+		for i, op := range ops {
+			if op.Create != nil {
+				*op.Create = file.addChirp(*op.Create)
+				continue
+			}
+
+			chirp, ok := file.Chirps[op.Delete]
+			switch {
+			case !ok:
+				results[i] = ErrChirpNotFound
+			case chirp.IsDeleted():
+				results[i] = ErrChirpDeleted
+			case chirp.AuthorId != authorId:
+				results[i] = ErrNotChirpAuthor
+			default:
+				chirp.DeletedAt = &now
+				file.Chirps[op.Delete] = chirp
+				continue
+			}
+			failed = true
+		}
+
+		if atomic && failed {
+			return ErrBatchAborted
+		}
+		return nil
+	})
+
+	return results, err
+}
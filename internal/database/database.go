@@ -14,15 +14,43 @@ type DB struct {
 }
 
 type File struct {
-	Chirps map[int]Chirp `json:"chirps"`
-	Users  map[string]User
-	Tokens map[string]Token
+	Chirps   map[int]Chirp `json:"chirps"`
+	Users    map[string]User
+	Tokens   map[string]Token
+	Sessions map[string]Session `json:"sessions"`
+	Follows  map[string]Follow  `json:"follows"`
+	// ActionTokens are single-use tokens sent by email, keyed by id.
+	ActionTokens map[string]ActionToken `json:"action_tokens"`
+	// ChirpViews holds daily impression counts, keyed by date and chirp id.
+	ChirpViews map[string]map[int]int `json:"chirp_views"`
+	APIKeys    map[string]APIKey      `json:"api_keys"`
+	// OAuthClients are third-party apps registered by users, keyed by
+	// client id, AuthorizationCodes the codes issued to them by code.
+	OAuthClients       map[string]OAuthClient       `json:"oauth_clients"`
+	AuthorizationCodes map[string]AuthorizationCode `json:"authorization_codes"`
+	// Identities link accounts at external OpenID providers to users.
+	Identities map[string]Identity `json:"identities"`
+	// WebhookEvents is the inbox of payment provider events, keyed by event
+	// id.
+	WebhookEvents map[string]WebhookEvent `json:"webhook_events"`
+	// LastUserId and LastChirpId are the highest ids handed out so far.
+	LastUserId  int `json:"last_user_id"`
+	LastChirpId int `json:"last_chirp_id"`
 }
 
 type Token struct {
 	Token     string    `json:"token"`
 	ID        int       `json:"id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// FamilyId is shared by every token rotated from the same login, it is
+	// also the id of the Session they belong to.
+	FamilyId string `json:"family_id"`
+	// ReplacedBy is set once the token has been rotated, presenting it again
+	// means it was stolen.
+	ReplacedBy string `json:"replaced_by,omitempty"`
+	// ClientId is the OAuth client the token was issued to, empty for
+	// first-party logins.
+	ClientId string `json:"client_id,omitempty"`
 }
 
 type User struct {
@@ -30,16 +58,75 @@ type User struct {
 	Email       string `json:"email"`
 	Password    string `json:"password"`
 	IsChirpyRed bool   `json:"is_chirpy_red"`
+	IsPrivate   bool   `json:"is_private"`
+	// EmailVerified is set once the user redeemed a verification token sent
+	// to Email.
+	EmailVerified bool `json:"email_verified"`
+	// SensitiveMedia is either SensitiveMediaExpand or SensitiveMediaHide,
+	// an empty value behaves like SensitiveMediaHide.
+	SensitiveMedia string `json:"sensitive_media"`
+	// TOTPSecret is set on enrollment, but only required at login once the
+	// user confirmed it and TOTPEnabled is true.
+	TOTPSecret    string   `json:"totp_secret,omitempty"`
+	TOTPEnabled   bool     `json:"totp_enabled"`
+	TOTPLastStep  int64    `json:"totp_last_step,omitempty"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// Role is one of the roles of auth, an empty value is a regular user.
+	Role string `json:"role,omitempty"`
+	// SuspendedAt marks an account an admin has suspended, which can neither
+	// log in nor use credentials issued before.
+	SuspendedAt      *time.Time `json:"suspended_at,omitempty"`
+	SuspensionReason string     `json:"suspension_reason,omitempty"`
+	// PasswordResetRequired blocks password logins until the password has
+	// been reset by email.
+	PasswordResetRequired bool `json:"password_reset_required,omitempty"`
+	// Subscription is the user's Chirpy Red subscription, nil if they never
+	// had one.
+	Subscription *Subscription `json:"subscription,omitempty"`
 }
 
+const (
+	SensitiveMediaExpand = "expand"
+	SensitiveMediaHide   = "hide"
+)
+
+const (
+	VisibilityPublic    = "public"
+	VisibilityFollowers = "followers"
+	VisibilityMentioned = "mentioned"
+)
+
 type Chirp struct {
-	ID       int    `json:"id"`
-	Body     string `json:"body"`
-	AuthorId int    `json:"author_id"`
+	ID         int    `json:"id"`
+	Body       string `json:"body"`
+	AuthorId   int    `json:"author_id"`
+	Visibility string `json:"visibility"`
+	Mentions   []int  `json:"mentions,omitempty"`
+	// ContentWarning is a short summary shown in place of the body until the
+	// reader chooses to expand the chirp.
+	ContentWarning string `json:"content_warning,omitempty"`
+	Sensitive      bool   `json:"sensitive"`
+	// DeletedAt marks a soft-deleted chirp, it is purged for good once the
+	// retention period has passed.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Views     int        `json:"views"`
 }
 
+var (
+	ErrChirpNotFound     = errors.New("Chirp not found")
+	ErrChirpDeleted      = errors.New("Chirp has been deleted")
+	ErrChirpNotDeleted   = errors.New("Chirp is not deleted")
+	ErrUndoWindowExpired = errors.New("Chirp can no longer be restored")
+)
+
+// CreateDB opens the database at path, creating an empty one when it does not
+// exist yet. Existing data is kept across restarts.
 func CreateDB(path string) (*DB, error) {
-	_, err := os.Create(path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Close()
 	if err != nil {
 		return nil, err
 	}
@@ -50,46 +137,129 @@ func CreateDB(path string) (*DB, error) {
 
 func (db *DB) ReadFile() (File, error) {
 	db.mu.RLock()
-	data, err := os.ReadFile("database.json")
+	defer db.mu.RUnlock()
+
+	return db.readFile()
+}
+
+// readFile loads the database without taking the lock, callers must hold it.
+func (db *DB) readFile() (File, error) {
+	data, err := os.ReadFile(db.path)
 	if err != nil {
 		return File{}, err
 	}
-	db.mu.RUnlock()
 
-	if len(data) == 0 {
-		file := File{
-			Chirps: map[int]Chirp{},
-			Users:  map[string]User{},
-			Tokens: map[string]Token{},
-		}
-		return file, nil
-	}
 	file := File{}
-	err = json.Unmarshal(data, &file)
-	if err != nil {
-		return File{}, err
+	if len(data) > 0 {
+		err = json.Unmarshal(data, &file)
+		if err != nil {
+			return File{}, err
+		}
 	}
+	file.ensureMaps()
 
 	return file, nil
 }
 
-func (db *DB) AddChirp(chirp Chirp) error {
-	file, err := db.ReadFile()
-
-	file.Chirps[chirp.ID] = chirp
+// ensureMaps initializes any collections missing from older database files.
+func (f *File) ensureMaps() {
+	if f.Chirps == nil {
+		f.Chirps = map[int]Chirp{}
+	}
+	if f.Users == nil {
+		f.Users = map[string]User{}
+	}
+	if f.Tokens == nil {
+		f.Tokens = map[string]Token{}
+	}
+	if f.Sessions == nil {
+		f.Sessions = map[string]Session{}
+	}
+	if f.Follows == nil {
+		f.Follows = map[string]Follow{}
+	}
+	if f.ActionTokens == nil {
+		f.ActionTokens = map[string]ActionToken{}
+	}
+	if f.ChirpViews == nil {
+		f.ChirpViews = map[string]map[int]int{}
+	}
+	if f.APIKeys == nil {
+		f.APIKeys = map[string]APIKey{}
+	}
+	if f.OAuthClients == nil {
+		f.OAuthClients = map[string]OAuthClient{}
+	}
+	if f.AuthorizationCodes == nil {
+		f.AuthorizationCodes = map[string]AuthorizationCode{}
+	}
+	if f.Identities == nil {
+		f.Identities = map[string]Identity{}
+	}
+	if f.WebhookEvents == nil {
+		f.WebhookEvents = map[string]WebhookEvent{}
+	}
+}
 
+// update reads the database, applies fn and writes the result back while
+// holding the write lock, so concurrent updates cannot overwrite each other.
+// Nothing is written if fn returns an error.
+func (db *DB) update(fn func(file *File) error) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
+
+	file, err := db.readFile()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&file)
+	if err != nil {
+		return err
+	}
+
 	data, err := json.Marshal(file)
 	if err != nil {
 		return err
 	}
 
-	os.WriteFile("database.json", data, 0666)
+	return os.WriteFile(db.path, data, 0666)
+}
+
+// nextChirpId returns the id for a new chirp. Ids are never reused, so links
+// and view counts of a purged chirp cannot carry over to a new one.
+func (f *File) nextChirpId() int {
+	for k := range f.Chirps {
+		if k > f.LastChirpId {
+			f.LastChirpId = k
+		}
+	}
+	f.LastChirpId++
+	return f.LastChirpId
+}
+
+// addChirp stores chirp under a new id and returns it with that id.
+func (f *File) addChirp(chirp Chirp) Chirp {
+	chirp.ID = f.nextChirpId()
+	f.Chirps[chirp.ID] = chirp
+	return chirp
+}
 
-	return nil
+// AddChirp stores a new chirp and returns it with the id it was given.
+func (db *DB) AddChirp(chirp Chirp) (Chirp, error) {
+	err := db.update(func(file *File) error {
+		chirp = file.addChirp(chirp)
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
 }
 
+// GetChirpById returns the chirp with the given id. Soft-deleted chirps are
+// returned together with ErrChirpDeleted.
 func (db *DB) GetChirpById(id int) (Chirp, error) {
 	file, err := db.ReadFile()
 	if err != nil {
@@ -98,32 +268,112 @@ func (db *DB) GetChirpById(id int) (Chirp, error) {
 
 	chirp, ok := file.Chirps[id]
 	if !ok {
-		return Chirp{}, errors.New("Not found")
+		return Chirp{}, ErrChirpNotFound
+	}
+	if chirp.IsDeleted() {
+		return chirp, ErrChirpDeleted
 	}
 
 	return chirp, nil
 }
 
+// DeleteChirpById soft-deletes a chirp by stamping it with a tombstone.
 func (db *DB) DeleteChirpById(id int) error {
-	file, err := db.ReadFile()
+	return db.update(func(file *File) error {
+		chirp, ok := file.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if chirp.IsDeleted() {
+			return ErrChirpDeleted
+		}
+
+		now := time.Now().UTC()
+		chirp.DeletedAt = &now
+		file.Chirps[id] = chirp
+		return nil
+	})
+}
+
+// RestoreChirp undoes a soft delete that happened less than window ago.
+func (db *DB) RestoreChirp(id int, window time.Duration) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if !existing.IsDeleted() {
+			return ErrChirpNotDeleted
+		}
+		if time.Since(*existing.DeletedAt) > window {
+			return ErrUndoWindowExpired
+		}
+
+		existing.DeletedAt = nil
+		file.Chirps[id] = existing
+		chirp = existing
+		return nil
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	delete(file.Chirps, id)
+	return chirp, nil
+}
 
-	data, err := json.Marshal(file)
+// PurgeDeletedChirps hard-deletes chirps that were soft-deleted before cutoff,
+// along with their view counts, and returns how many were removed.
+func (db *DB) PurgeDeletedChirps(cutoff time.Time) (int, error) {
+	purged := 0
+	err := db.update(func(file *File) error {
+		for id, chirp := range file.Chirps {
+			if chirp.IsDeleted() && chirp.DeletedAt.Before(cutoff) {
+				delete(file.Chirps, id)
+				for _, daily := range file.ChirpViews {
+					delete(daily, id)
+				}
+				purged++
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	err = os.WriteFile(db.path, data, 0666)
+	return purged, nil
+}
+
+func (db *DB) SetContentWarning(id int, warning string, sensitive bool) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if existing.IsDeleted() {
+			return ErrChirpDeleted
+		}
+
+		existing.ContentWarning = warning
+		existing.Sensitive = sensitive
+		file.Chirps[id] = existing
+		chirp = existing
+		return nil
+	})
 	if err != nil {
-		return err
+		return Chirp{}, err
 	}
 
-	return nil
+	return chirp, nil
+}
+
+// IsFlagged reports whether the chirp is hidden behind a content warning.
+func (chirp Chirp) IsFlagged() bool {
+	return chirp.Sensitive || chirp.ContentWarning != ""
+}
+
+func (chirp Chirp) IsDeleted() bool {
+	return chirp.DeletedAt != nil
 }
@@ -0,0 +1,78 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+
+	db, err := CreateDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestPurgeThenCreateChirp(t *testing.T) {
+	db := newTestDB(t)
+	now := time.Now().UTC()
+
+	first, err := db.AddChirp(Chirp{Body: "first", AuthorId: 1, Visibility: VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := db.AddChirp(Chirp{Body: "last", AuthorId: 1, Visibility: VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.RecordChirpViews(now, map[int]int{first.ID: 2, last.ID: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// purge the chirp with the highest id, whose id must not be handed out
+	// again
+	err = db.DeleteChirpById(last.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged, err := db.PurgeDeletedChirps(now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Fatalf("PurgeDeletedChirps() = %d, want 1", purged)
+	}
+
+	created, err := db.AddChirp(Chirp{Body: "new", AuthorId: 1, Visibility: VisibilityPublic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID <= last.ID {
+		t.Fatalf("AddChirp() id = %d, want more than the purged %d", created.ID, last.ID)
+	}
+
+	_, err = db.GetChirpById(last.ID)
+	if !errors.Is(err, ErrChirpNotFound) {
+		t.Fatalf("GetChirpById(%d) error = %v, want %v", last.ID, err, ErrChirpNotFound)
+	}
+
+	file, err := db.ReadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	daily := file.ChirpViews[now.Format(DateLayout)]
+	if _, ok := daily[last.ID]; ok {
+		t.Errorf("views of purged chirp %d were kept", last.ID)
+	}
+	if daily[first.ID] != 2 {
+		t.Errorf("views of chirp %d = %d, want 2", first.ID, daily[first.ID])
+	}
+	if file.Chirps[created.ID].Views != 0 {
+		t.Errorf("new chirp %d starts with %d views, want 0", created.ID, file.Chirps[created.ID].Views)
+	}
+}
@@ -0,0 +1,209 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	FollowPending  = "pending"
+	FollowAccepted = "accepted"
+)
+
+var (
+	ErrFollowSelf           = errors.New("Users cannot follow themselves")
+	ErrFollowNotFound       = errors.New("Follow does not exist")
+	ErrFollowRequestMissing = errors.New("Follow request does not exist")
+)
+
+type Follow struct {
+	FollowerId int        `json:"follower_id"`
+	FolloweeId int        `json:"followee_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+}
+
+func followKey(followerId, followeeId int) string {
+	return fmt.Sprintf("%d:%d", followerId, followeeId)
+}
+
+// Follow makes followerId follow followeeId. Following a private account
+// creates a pending request that the followee has to approve.
+func (db *DB) Follow(followerId, followeeId int) (Follow, error) {
+	if followerId == followeeId {
+		return Follow{}, ErrFollowSelf
+	}
+
+	follow := Follow{}
+	err := db.update(func(file *File) error {
+		followee, ok := file.UserById(followeeId)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+
+		key := followKey(followerId, followeeId)
+		if existing, ok := file.Follows[key]; ok {
+			follow = existing
+			return nil
+		}
+
+		now := time.Now().UTC()
+		follow = Follow{
+			FollowerId: followerId,
+			FolloweeId: followeeId,
+			Status:     FollowAccepted,
+			CreatedAt:  now,
+			AcceptedAt: &now,
+		}
+		if followee.IsPrivate {
+			follow.Status = FollowPending
+			follow.AcceptedAt = nil
+		}
+		file.Follows[key] = follow
+		return nil
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+// Unfollow removes a follow or withdraws a pending follow request.
+func (db *DB) Unfollow(followerId, followeeId int) error {
+	return db.update(func(file *File) error {
+		key := followKey(followerId, followeeId)
+		if _, ok := file.Follows[key]; !ok {
+			return ErrFollowNotFound
+		}
+		delete(file.Follows, key)
+		return nil
+	})
+}
+
+func (db *DB) PendingFollowRequests(followeeId int) ([]Follow, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	requests := []Follow{}
+	for _, v := range file.Follows {
+		if v.FolloweeId == followeeId && v.Status == FollowPending {
+			requests = append(requests, v)
+		}
+	}
+
+	return requests, nil
+}
+
+func (db *DB) ApproveFollowRequest(followeeId, followerId int) (Follow, error) {
+	follow := Follow{}
+	err := db.update(func(file *File) error {
+		key := followKey(followerId, followeeId)
+		existing, ok := file.Follows[key]
+		if !ok || existing.Status != FollowPending {
+			return ErrFollowRequestMissing
+		}
+
+		now := time.Now().UTC()
+		existing.Status = FollowAccepted
+		existing.AcceptedAt = &now
+		file.Follows[key] = existing
+		follow = existing
+		return nil
+	})
+	if err != nil {
+		return Follow{}, err
+	}
+
+	return follow, nil
+}
+
+func (db *DB) RejectFollowRequest(followeeId, followerId int) error {
+	return db.update(func(file *File) error {
+		key := followKey(followerId, followeeId)
+		existing, ok := file.Follows[key]
+		if !ok || existing.Status != FollowPending {
+			return ErrFollowRequestMissing
+		}
+		delete(file.Follows, key)
+		return nil
+	})
+}
+
+// SetPrivate toggles private-account mode. Making an account public again
+// approves every request that was still pending.
+func (db *DB) SetPrivate(id int, private bool) (User, error) {
+	user := User{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+
+		existing.IsPrivate = private
+		file.Users[existing.Email] = existing
+		user = existing
+
+		if private {
+			return nil
+		}
+		now := time.Now().UTC()
+		for k, v := range file.Follows {
+			if v.FolloweeId == id && v.Status == FollowPending {
+				v.Status = FollowAccepted
+				v.AcceptedAt = &now
+				file.Follows[k] = v
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+func (f File) UserById(id int) (User, bool) {
+	for _, v := range f.Users {
+		if v.ID == id {
+			return v, true
+		}
+	}
+	return User{}, false
+}
+
+func (f File) IsFollowing(followerId, followeeId int) bool {
+	follow, ok := f.Follows[followKey(followerId, followeeId)]
+	return ok && follow.Status == FollowAccepted
+}
+
+// CanViewChirp reports whether viewerId may see chirp. A viewerId of 0 is an
+// unauthenticated caller, who only ever sees public chirps of public accounts.
+func (f File) CanViewChirp(chirp Chirp, viewerId int) bool {
+	if viewerId != 0 && chirp.AuthorId == viewerId {
+		return true
+	}
+
+	switch chirp.Visibility {
+	case VisibilityMentioned:
+		for _, id := range chirp.Mentions {
+			if viewerId != 0 && id == viewerId {
+				return true
+			}
+		}
+		return false
+	case VisibilityFollowers:
+		return viewerId != 0 && f.IsFollowing(viewerId, chirp.AuthorId)
+	default:
+		author, ok := f.UserById(chirp.AuthorId)
+		if ok && author.IsPrivate {
+			return viewerId != 0 && f.IsFollowing(viewerId, chirp.AuthorId)
+		}
+		return true
+	}
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrEmailNotVerified = errors.New("An account with this email exists but its email is not verified")
+
+// Identity links an account at an external OpenID Connect provider to a
+// user. Subject is only unique within Issuer.
+type Identity struct {
+	Provider string    `json:"provider"`
+	Issuer   string    `json:"issuer"`
+	Subject  string    `json:"subject"`
+	UserId   int       `json:"user_id"`
+	Email    string    `json:"email"`
+	LinkedAt time.Time `json:"linked_at"`
+}
+
+func identityKey(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// SignInWithIdentity returns the user linked to identity. An unlinked
+// identity is linked to the user with the same email, which must have been
+// verified on both sides, or to a new user without a password. created
+// reports whether a user was created.
+func (db *DB) SignInWithIdentity(identity Identity) (User, bool, error) {
+	user := User{}
+	created := false
+	err := db.update(func(file *File) error {
+		key := identityKey(identity.Issuer, identity.Subject)
+		if linked, ok := file.Identities[key]; ok {
+			var found bool
+			user, found = file.UserById(linked.UserId)
+			if !found {
+				return errors.New("User does not exist")
+			}
+			return nil
+		}
+
+		existing, ok := file.Users[identity.Email]
+		switch {
+		case ok && !existing.EmailVerified:
+			// otherwise whoever registered the address first, without
+			// proving they own it, would share the account
+			return ErrEmailNotVerified
+		case ok:
+			user = existing
+		default:
+			user = User{
+				ID:            file.nextUserId(),
+				Email:         identity.Email,
+				EmailVerified: true,
+			}
+			file.Users[user.Email] = user
+			created = true
+		}
+
+		identity.UserId = user.ID
+		identity.LinkedAt = time.Now().UTC()
+		file.Identities[key] = identity
+		return nil
+	})
+	if err != nil {
+		return User{}, false, err
+	}
+
+	return user, created, nil
+}
@@ -0,0 +1,79 @@
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+)
+
+var (
+	ErrTOTPAlreadyEnabled  = errors.New("Two-factor authentication is already enabled")
+	ErrTOTPNotEnrolled     = errors.New("Two-factor authentication has not been set up")
+	ErrTOTPCodeReused      = errors.New("Code has already been used")
+	ErrRecoveryCodeInvalid = errors.New("Recovery code is invalid")
+)
+
+// SetPendingTOTPSecret stores a freshly generated secret which stays inactive
+// until EnableTOTP confirms the user can generate codes for it.
+func (db *DB) SetPendingTOTPSecret(id int, secret string) error {
+	return db.updateUser(id, func(user *User) error {
+		if user.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		user.TOTPSecret = secret
+		user.TOTPLastStep = 0
+		return nil
+	})
+}
+
+// EnableTOTP activates the pending secret, step is the time step of the code
+// used to confirm it and recoveryCodes the hashed recovery codes.
+func (db *DB) EnableTOTP(id int, step int64, recoveryCodes []string) error {
+	return db.updateUser(id, func(user *User) error {
+		if user.TOTPEnabled {
+			return ErrTOTPAlreadyEnabled
+		}
+		if user.TOTPSecret == "" {
+			return ErrTOTPNotEnrolled
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodes
+		return nil
+	})
+}
+
+func (db *DB) DisableTOTP(id int) error {
+	return db.updateUser(id, func(user *User) error {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// RecordTOTPStep marks the time step of a code as used, refusing steps that
+// are not newer than the last one so codes cannot be replayed.
+func (db *DB) RecordTOTPStep(id int, step int64) error {
+	return db.updateUser(id, func(user *User) error {
+		if step <= user.TOTPLastStep {
+			return ErrTOTPCodeReused
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+}
+
+// UseRecoveryCode consumes the recovery code hashed to codeHash, comparing
+// hashes in constant time.
+func (db *DB) UseRecoveryCode(id int, codeHash string) error {
+	return db.updateUser(id, func(user *User) error {
+		for i, hash := range user.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(hash), []byte(codeHash)) == 1 {
+				user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+				return nil
+			}
+		}
+		return ErrRecoveryCodeInvalid
+	})
+}
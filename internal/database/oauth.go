@@ -0,0 +1,221 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrClientNotFound = errors.New("Client not found")
+	ErrCodeInvalid    = errors.New("Authorization code is invalid")
+	ErrCodeExpired    = errors.New("Authorization code has expired")
+	ErrCodeReused     = errors.New("Authorization code has already been used")
+)
+
+// OAuthClient is a third-party app allowed to request access to Chirpy
+// accounts. Public clients, such as mobile apps, have no secret.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	OwnerId      int       `json:"owner_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (c OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+// AllowsRedirect reports whether uri is one of the registered redirect URIs,
+// which must match exactly.
+func (c OAuthClient) AllowsRedirect(uri string) bool {
+	for _, v := range c.RedirectURIs {
+		if v == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizationCode is issued once a user consented to a client's request.
+// SessionId is set when the code is redeemed.
+type AuthorizationCode struct {
+	Code          string    `json:"code"`
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	SessionId     string    `json:"session_id,omitempty"`
+}
+
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	client.CreatedAt = time.Now().UTC()
+	err := db.update(func(file *File) error {
+		file.OAuthClients[client.ID] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	client, ok := file.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, ErrClientNotFound
+	}
+
+	return client, nil
+}
+
+// ListOAuthClients returns the clients registered by ownerId, newest first.
+func (db *DB) ListOAuthClients(ownerId int) ([]OAuthClient, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []OAuthClient{}
+	for _, v := range file.OAuthClients {
+		if v.OwnerId == ownerId {
+			clients = append(clients, v)
+		}
+	}
+	sort.Slice(clients, func(a, b int) bool {
+		return clients[a].CreatedAt.After(clients[b].CreatedAt)
+	})
+
+	return clients, nil
+}
+
+// DeleteOAuthClient removes a client together with its pending codes and
+// every session granted to it.
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	return db.update(func(file *File) error {
+		client, ok := file.OAuthClients[id]
+		if !ok || client.OwnerId != ownerId {
+			return ErrClientNotFound
+		}
+		delete(file.OAuthClients, id)
+
+		for k, v := range file.AuthorizationCodes {
+			if v.ClientId == id {
+				delete(file.AuthorizationCodes, k)
+			}
+		}
+		for k, v := range file.Sessions {
+			if v.ClientId == id {
+				file.revokeSession(k)
+			}
+		}
+		return nil
+	})
+}
+
+func (db *DB) CreateAuthorizationCode(code AuthorizationCode) error {
+	return db.update(func(file *File) error {
+		now := time.Now().UTC()
+		for k, v := range file.AuthorizationCodes {
+			if v.ExpiresAt.Before(now) {
+				delete(file.AuthorizationCodes, k)
+			}
+		}
+		file.AuthorizationCodes[code.Code] = code
+		return nil
+	})
+}
+
+func (db *DB) GetAuthorizationCode(code string) (AuthorizationCode, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	record, ok := file.AuthorizationCodes[code]
+	if !ok {
+		return AuthorizationCode{}, ErrCodeInvalid
+	}
+
+	return record, nil
+}
+
+// RedeemAuthorizationCode exchanges code for a new session of the client,
+// with refreshToken as its first refresh token. A code can only be redeemed
+// once, presenting it again revokes the session it was exchanged for.
+func (db *DB) RedeemAuthorizationCode(code, refreshToken, userAgent, ip string) (Session, error) {
+	session := Session{}
+	reused := false
+	err := db.update(func(file *File) error {
+		record, ok := file.AuthorizationCodes[code]
+		if !ok {
+			return ErrCodeInvalid
+		}
+		if record.SessionId != "" {
+			file.revokeSession(record.SessionId)
+			reused = true
+			return nil
+		}
+		if record.ExpiresAt.Before(time.Now().UTC()) {
+			return ErrCodeExpired
+		}
+
+		var err error
+		session, err = file.createSession(Session{
+			UserId:    record.UserId,
+			UserAgent: userAgent,
+			IP:        ip,
+			ClientId:  record.ClientId,
+			Scopes:    record.Scopes,
+		}, refreshToken)
+		if err != nil {
+			return err
+		}
+
+		record.SessionId = session.ID
+		file.AuthorizationCodes[code] = record
+		return nil
+	})
+	if err != nil {
+		return Session{}, err
+	}
+	if reused {
+		return Session{}, ErrCodeReused
+	}
+
+	return session, nil
+}
+
+// RevokeClientToken revokes the session of a refresh token issued to
+// clientId. Unknown tokens are ignored, as RFC 7009 asks.
+func (db *DB) RevokeClientToken(clientId, token string) error {
+	return db.update(func(file *File) error {
+		record, ok := file.Tokens[token]
+		if ok && record.ClientId == clientId {
+			file.revokeSession(record.FamilyId)
+		}
+		return nil
+	})
+}
+
+// RevokeClientSession revokes a session granted to clientId.
+func (db *DB) RevokeClientSession(clientId, id string) error {
+	return db.update(func(file *File) error {
+		session, ok := file.Sessions[id]
+		if ok && session.ClientId == clientId {
+			file.revokeSession(id)
+		}
+		return nil
+	})
+}
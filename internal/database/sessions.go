@@ -0,0 +1,129 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrSessionNotFound = errors.New("Session not found")
+
+// Session is a login on one device. Its id is the family id shared by the
+// refresh tokens rotated from that login.
+type Session struct {
+	ID         string    `json:"id"`
+	UserId     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	// ClientId is set on sessions granted to a third-party OAuth client,
+	// which may only act within Scopes.
+	ClientId string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// CreateSession starts a new session for userId with token as its first
+// refresh token.
+func (db *DB) CreateSession(userId int, token, userAgent, ip string) (Session, error) {
+	session := Session{}
+	err := db.update(func(file *File) error {
+		var err error
+		session, err = file.createSession(Session{UserId: userId, UserAgent: userAgent, IP: ip}, token)
+		return err
+	})
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// createSession stores session under a new id with token as its first
+// refresh token.
+func (f *File) createSession(session Session, token string) (Session, error) {
+	id, err := newFamilyId()
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	session.ID = id
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	f.Sessions[id] = session
+	f.Tokens[token] = Token{
+		Token:     token,
+		ID:        session.UserId,
+		ExpiresAt: now.Add(refreshTokenLifetime),
+		FamilyId:  id,
+		ClientId:  session.ClientId,
+	}
+
+	return session, nil
+}
+
+func (db *DB) LookupSession(id string) (Session, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, ok := file.Sessions[id]
+	if !ok {
+		return Session{}, ErrSessionNotFound
+	}
+
+	return session, nil
+}
+
+// ListSessions returns the sessions of userId, most recently used first.
+func (db *DB) ListSessions(userId int) ([]Session, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []Session{}
+	for _, v := range file.Sessions {
+		if v.UserId == userId {
+			sessions = append(sessions, v)
+		}
+	}
+	sort.Slice(sessions, func(a, b int) bool {
+		return sessions[a].LastUsedAt.After(sessions[b].LastUsedAt)
+	})
+
+	return sessions, nil
+}
+
+func (db *DB) RevokeSession(userId int, id string) error {
+	return db.update(func(file *File) error {
+		session, ok := file.Sessions[id]
+		if !ok || session.UserId != userId {
+			return ErrSessionNotFound
+		}
+		file.revokeSession(id)
+		return nil
+	})
+}
+
+// RevokeAllSessions revokes every session of userId except keepId, which may
+// be empty, and returns how many were revoked.
+func (db *DB) RevokeAllSessions(userId int, keepId string) (int, error) {
+	revoked := 0
+	err := db.update(func(file *File) error {
+		for id, session := range file.Sessions {
+			if session.UserId == userId && id != keepId {
+				file.revokeSession(id)
+				revoked++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revoked, nil
+}
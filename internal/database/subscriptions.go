@@ -0,0 +1,238 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+const PlanChirpyRed = "chirpy_red"
+
+const (
+	// SubscriptionActive is paid up until ExpiresAt.
+	SubscriptionActive = "active"
+	// SubscriptionPastDue failed to renew, the user keeps the plan until
+	// GraceEndsAt for the payment to go through.
+	SubscriptionPastDue = "past_due"
+	// SubscriptionCanceled will not renew, the user keeps the plan until
+	// ExpiresAt.
+	SubscriptionCanceled = "canceled"
+	SubscriptionExpired  = "expired"
+	SubscriptionRefunded = "refunded"
+)
+
+const (
+	SubscriptionSourcePolka = "polka"
+	SubscriptionSourceAdmin = "admin"
+)
+
+var ErrNoSubscription = errors.New("User has no subscription")
+
+// Subscription is a user's paid plan. User.IsChirpyRed is kept in step with
+// it, true for as long as the subscription grants the plan.
+type Subscription struct {
+	Plan   string `json:"plan"`
+	Status string `json:"status"`
+	// Source is who started the subscription, Polka or an admin.
+	Source    string     `json:"source"`
+	StartedAt time.Time  `json:"started_at"`
+	RenewedAt *time.Time `json:"renewed_at,omitempty"`
+	// ExpiresAt is the end of the paid period, nil for a subscription
+	// granted by an admin without an end.
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CanceledAt  *time.Time `json:"canceled_at,omitempty"`
+	GraceEndsAt *time.Time `json:"grace_ends_at,omitempty"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+}
+
+// Entitled reports whether the subscription currently grants its plan.
+func (s Subscription) Entitled() bool {
+	return s.Status == SubscriptionActive || s.Status == SubscriptionPastDue || s.Status == SubscriptionCanceled
+}
+
+// CurrentSubscription returns the user's subscription and whether they have
+// one. Users upgraded before subscriptions were tracked hold an active one
+// without an end.
+func (u User) CurrentSubscription() (Subscription, bool) {
+	if u.Subscription != nil {
+		return *u.Subscription, true
+	}
+	if u.IsChirpyRed {
+		return Subscription{Plan: PlanChirpyRed, Status: SubscriptionActive, Source: SubscriptionSourcePolka}, true
+	}
+	return Subscription{}, false
+}
+
+// setSubscription stores sub on the user and updates IsChirpyRed to match.
+func (u *User) setSubscription(sub Subscription) {
+	u.Subscription = &sub
+	u.IsChirpyRed = sub.Entitled()
+}
+
+// StartSubscription subscribes the user to plan until expiresAt. A
+// subscription the user still holds is reactivated instead, keeping when it
+// started.
+func (db *DB) StartSubscription(id int, plan, source string, expiresAt *time.Time) (User, error) {
+	return db.updateSubscription(id, func(user *User, now time.Time) error {
+		sub := Subscription{Plan: plan, Source: source, StartedAt: now}
+		if current, ok := user.CurrentSubscription(); ok && current.Entitled() && !current.StartedAt.IsZero() {
+			sub.StartedAt = current.StartedAt
+			sub.RenewedAt = &now
+		}
+		sub.Status = SubscriptionActive
+		sub.ExpiresAt = expiresAt
+		user.setSubscription(sub)
+		return nil
+	})
+}
+
+// RenewSubscription extends the user's subscription to expiresAt, or by
+// period from the end of the current one when expiresAt is nil, and clears
+// any cancellation or missed payment.
+func (db *DB) RenewSubscription(id int, expiresAt *time.Time, period time.Duration) (User, error) {
+	return db.updateSubscription(id, func(user *User, now time.Time) error {
+		sub, ok := user.CurrentSubscription()
+		if !ok {
+			return ErrNoSubscription
+		}
+		if expiresAt == nil {
+			end := now
+			if sub.ExpiresAt != nil && sub.ExpiresAt.After(now) {
+				end = *sub.ExpiresAt
+			}
+			end = end.Add(period)
+			expiresAt = &end
+		}
+		// a late renewal does not shorten a later end already known
+		if sub.Entitled() && sub.ExpiresAt != nil && sub.ExpiresAt.After(*expiresAt) {
+			expiresAt = sub.ExpiresAt
+		}
+
+		sub.Status = SubscriptionActive
+		sub.RenewedAt = &now
+		sub.ExpiresAt = expiresAt
+		sub.CanceledAt = nil
+		sub.GraceEndsAt = nil
+		sub.EndedAt = nil
+		user.setSubscription(sub)
+		return nil
+	})
+}
+
+// CancelSubscription stops the user's subscription from renewing. The plan
+// is kept until the paid period ends, or lost right away when it has none.
+func (db *DB) CancelSubscription(id int) (User, error) {
+	return db.updateSubscription(id, func(user *User, now time.Time) error {
+		sub, ok := user.CurrentSubscription()
+		if !ok || !sub.Entitled() {
+			return ErrNoSubscription
+		}
+		if sub.CanceledAt == nil {
+			sub.CanceledAt = &now
+		}
+		sub.GraceEndsAt = nil
+		sub.Status = SubscriptionCanceled
+		if sub.ExpiresAt == nil || !sub.ExpiresAt.After(now) {
+			sub.Status = SubscriptionExpired
+			sub.EndedAt = &now
+		}
+		user.setSubscription(sub)
+		return nil
+	})
+}
+
+// MarkSubscriptionPastDue records a failed payment, the user keeps the plan
+// until graceEndsAt. Canceled subscriptions are left as they are.
+func (db *DB) MarkSubscriptionPastDue(id int, graceEndsAt time.Time) (User, error) {
+	return db.updateSubscription(id, func(user *User, now time.Time) error {
+		sub, ok := user.CurrentSubscription()
+		if !ok || !sub.Entitled() {
+			return ErrNoSubscription
+		}
+		if sub.Status == SubscriptionCanceled {
+			return nil
+		}
+		sub.Status = SubscriptionPastDue
+		sub.GraceEndsAt = &graceEndsAt
+		user.setSubscription(sub)
+		return nil
+	})
+}
+
+// EndSubscription ends the user's subscription right away with status,
+// SubscriptionExpired or SubscriptionRefunded.
+func (db *DB) EndSubscription(id int, status string) (User, error) {
+	return db.updateSubscription(id, func(user *User, now time.Time) error {
+		sub, ok := user.CurrentSubscription()
+		if !ok {
+			return ErrNoSubscription
+		}
+		sub.Status = status
+		sub.GraceEndsAt = nil
+		sub.EndedAt = &now
+		user.setSubscription(sub)
+		return nil
+	})
+}
+
+// ExpireSubscriptions moves subscriptions along once their time is up: an
+// active subscription not renewed by its end becomes past due for grace, a
+// past due one whose grace ended and a canceled one whose paid period ended
+// expire. It returns the users whose subscription changed.
+func (db *DB) ExpireSubscriptions(now time.Time, grace time.Duration) ([]User, error) {
+	changed := []User{}
+	err := db.update(func(file *File) error {
+		for email, user := range file.Users {
+			if user.Subscription == nil {
+				continue
+			}
+
+			sub := *user.Subscription
+			switch {
+			case sub.Status == SubscriptionActive && sub.ExpiresAt != nil && !sub.ExpiresAt.After(now):
+				graceEndsAt := sub.ExpiresAt.Add(grace)
+				sub.Status = SubscriptionPastDue
+				sub.GraceEndsAt = &graceEndsAt
+				if !graceEndsAt.After(now) {
+					sub.Status = SubscriptionExpired
+					sub.GraceEndsAt = nil
+					sub.EndedAt = &now
+				}
+			case sub.Status == SubscriptionPastDue && sub.GraceEndsAt != nil && !sub.GraceEndsAt.After(now),
+				sub.Status == SubscriptionCanceled && sub.ExpiresAt != nil && !sub.ExpiresAt.After(now):
+				sub.Status = SubscriptionExpired
+				sub.GraceEndsAt = nil
+				sub.EndedAt = &now
+			default:
+				continue
+			}
+
+			user.setSubscription(sub)
+			file.Users[email] = user
+			changed = append(changed, user)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changed, nil
+}
+
+// updateSubscription applies fn to the user and returns the result.
+func (db *DB) updateSubscription(id int, fn func(user *User, now time.Time) error) (User, error) {
+	updated := User{}
+	err := db.updateUser(id, func(user *User) error {
+		err := fn(user, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		updated = *user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return updated, nil
+}
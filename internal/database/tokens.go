@@ -0,0 +1,91 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const refreshTokenLifetime = 60 * 24 * time.Hour
+
+var (
+	ErrTokenNotFound = errors.New("Token not found")
+	ErrTokenExpired  = errors.New("Token is expired")
+	ErrTokenReused   = errors.New("Token has already been used")
+)
+
+// RotateRefreshToken swaps oldToken for newToken within the same family and
+// records the use on its session. Only tokens issued to clientId, empty for
+// first-party logins, can be rotated. Presenting a token that was already
+// rotated revokes the whole family and returns ErrTokenReused, along with the
+// reused token so it can be reported.
+func (db *DB) RotateRefreshToken(oldToken, newToken, clientId, userAgent, ip string) (Token, error) {
+	rotated := Token{}
+	reused := false
+	err := db.update(func(file *File) error {
+		token, ok := file.Tokens[oldToken]
+		if !ok || token.ClientId != clientId {
+			return ErrTokenNotFound
+		}
+		if token.ReplacedBy != "" {
+			file.revokeSession(token.FamilyId)
+			rotated = token
+			reused = true
+			return nil
+		}
+		if CheckTokenExpiration(token) != nil {
+			return ErrTokenExpired
+		}
+
+		token.ReplacedBy = newToken
+		file.Tokens[oldToken] = token
+
+		rotated = Token{
+			Token:     newToken,
+			ID:        token.ID,
+			ExpiresAt: time.Now().UTC().Add(refreshTokenLifetime),
+			FamilyId:  token.FamilyId,
+			ClientId:  token.ClientId,
+		}
+		file.Tokens[newToken] = rotated
+
+		session := file.Sessions[token.FamilyId]
+		session.LastUsedAt = time.Now().UTC()
+		session.UserAgent = userAgent
+		session.IP = ip
+		file.Sessions[token.FamilyId] = session
+		return nil
+	})
+	if err != nil {
+		return Token{}, err
+	}
+	if reused {
+		return rotated, ErrTokenReused
+	}
+
+	return rotated, nil
+}
+
+// revokeSession deletes a session together with its token family.
+func (f *File) revokeSession(id string) {
+	if id == "" {
+		return
+	}
+	delete(f.Sessions, id)
+	for k, v := range f.Tokens {
+		if v.FamilyId == id {
+			delete(f.Tokens, k)
+		}
+	}
+}
+
+func newFamilyId() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
@@ -1,9 +1,7 @@
 package database
 
 import (
-	"encoding/json"
 	"errors"
-	"os"
 	"time"
 )
 
@@ -24,100 +22,53 @@ func (db *DB) GetUserByEmail(email string) (User, error) {
 }
 
 func (db *DB) CreateUser(email string, password string) (User, error) {
-	file, err := db.ReadFile()
-	if err != nil {
-		return User{}, err
-	}
-
-	_, err = db.GetUserByEmail(email)
-	if err == nil {
-		return User{}, ErrUserAlreadyExists
-	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	id := len(file.Users) + 1
-
-	user := User{
-		ID:       id,
-		Email:    email,
-		Password: password,
-	}
-
-	file.Users[email] = user
+	user := User{}
+	err := db.update(func(file *File) error {
+		if _, ok := file.Users[email]; ok {
+			return ErrUserAlreadyExists
+		}
 
-	data, err := json.Marshal(file)
+		user = User{
+			ID:       file.nextUserId(),
+			Email:    email,
+			Password: password,
+		}
+		file.Users[email] = user
+		return nil
+	})
 	if err != nil {
-		return User{}, errors.New("Failed to marshal user object")
+		return User{}, err
 	}
 
-	os.WriteFile(db.path, data, 0666)
 	return user, nil
 }
 
-func (db *DB) UpdateCredentials(id int, email, password string) (User, error) {
-	file, err := db.ReadFile()
-	if err != nil {
-		return User{}, err
-	}
-
-	hashedPassword, err := HashPassword(password)
-	if err != nil {
-		return User{}, err
-	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	updatedUser := User{
-		ID:       id,
-		Email:    email,
-		Password: hashedPassword,
-	}
-
-	for k, v := range file.Users {
-		if v.ID == id {
-			delete(file.Users, k)
-			file.Users[email] = updatedUser
+// ChangeEmail moves the user with the given id to a new, already confirmed
+// email address, keeping every other field. It fails with
+// ErrUserAlreadyExists when another user has the address.
+func (db *DB) ChangeEmail(id int, email string) (User, error) {
+	user := User{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+		if other, taken := file.Users[email]; taken && other.ID != id {
+			return ErrUserAlreadyExists
 		}
-	}
 
-	data, err := json.Marshal(file)
+		delete(file.Users, existing.Email)
+		existing.Email = email
+		existing.EmailVerified = true
+		file.Users[email] = existing
+		user = existing
+		return nil
+	})
 	if err != nil {
 		return User{}, err
 	}
 
-	os.WriteFile(db.path, data, 0666)
-
-	return updatedUser, nil
-}
-
-func (db *DB) UpdateRefreshToken(id int, token string) error {
-	file, err := db.ReadFile()
-	if err != nil {
-		return err
-	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	tokenStruct := Token{
-		Token:     token,
-		ID:        id,
-		ExpiresAt: time.Now().UTC().Add(60 * 24 * time.Hour),
-	}
-
-	file.Tokens[token] = tokenStruct
-
-	data, err := json.Marshal(file)
-	if err != nil {
-		return err
-	}
-
-	os.WriteFile(db.path, data, 0666)
-
-	return nil
+	return user, nil
 }
 
 func (db *DB) LookupToken(tokenStr string) (Token, error) {
@@ -132,7 +83,7 @@ func (db *DB) LookupToken(tokenStr string) (Token, error) {
 	token, ok := file.Tokens[tokenStr]
 
 	if !ok {
-		return Token{}, errors.New("Token not found")
+		return Token{}, ErrTokenNotFound
 	}
 
 	return token, nil
@@ -140,30 +91,23 @@ func (db *DB) LookupToken(tokenStr string) (Token, error) {
 
 func CheckTokenExpiration(token Token) error {
 	if token.ExpiresAt.Before(time.Now().UTC()) {
-		return errors.New("Token is expired")
+		return ErrTokenExpired
 	}
 
 	return nil
 }
 
+// DeleteToken revokes tokenStr along with the rest of its session.
 func (db *DB) DeleteToken(tokenStr string) error {
-	file, err := db.ReadFile()
-	if err != nil {
-		return err
-	}
-
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	delete(file.Tokens, tokenStr)
-
-	data, err := json.Marshal(file)
-	if err != nil {
-		return err
-	}
-
-	os.WriteFile(db.path, data, 0666)
-	return nil
+	return db.update(func(file *File) error {
+		token, ok := file.Tokens[tokenStr]
+		if !ok {
+			return nil
+		}
+		file.revokeSession(token.FamilyId)
+		delete(file.Tokens, tokenStr)
+		return nil
+	})
 }
 
 func (db *DB) FindUserById(id int) (User, error) {
@@ -181,34 +125,108 @@ func (db *DB) FindUserById(id int) (User, error) {
 	return User{}, errors.New("User does not exist")
 }
 
-func (db *DB) UpgradeUser(email string) error {
-	file, err := db.ReadFile()
+func (db *DB) SetSensitiveMediaPreference(id int, preference string) (User, error) {
+	user := User{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+
+		existing.SensitiveMedia = preference
+		file.Users[existing.Email] = existing
+		user = existing
+		return nil
+	})
 	if err != nil {
-		return err
+		return User{}, err
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	return user, nil
+}
 
-	user, ok := file.Users[email]
-	if !ok {
-		return errors.New("User does not exist")
-	}
+// SetPassword replaces the password hash of the user, which satisfies a
+// required password reset.
+func (db *DB) SetPassword(id int, hashedPassword string) error {
+	return db.updateUser(id, func(user *User) error {
+		user.Password = hashedPassword
+		user.PasswordResetRequired = false
+		return nil
+	})
+}
 
-	updated := User{
-		Email:       user.Email,
-		Password:    user.Password,
-		ID:          user.ID,
-		IsChirpyRed: true,
-	}
-	file.Users[email] = updated
+// ResetPassword sets the password of the user, provided their email is still
+// email, the address the reset link was sent to.
+func (db *DB) ResetPassword(id int, email, hashedPassword string) error {
+	return db.updateUser(id, func(user *User) error {
+		if user.Email != email {
+			return ErrActionTokenInvalid
+		}
+		user.Password = hashedPassword
+		user.PasswordResetRequired = false
+		return nil
+	})
+}
+
+// MarkEmailVerified verifies the email of the user, provided it is still
+// email, the address the verification was sent to.
+func (db *DB) MarkEmailVerified(id int, email string) error {
+	return db.updateUser(id, func(user *User) error {
+		if user.Email != email {
+			return ErrActionTokenInvalid
+		}
+		user.EmailVerified = true
+		return nil
+	})
+}
 
-	data, err := json.Marshal(file)
+func (db *DB) SetRole(id int, role string) error {
+	return db.updateUser(id, func(user *User) error {
+		user.Role = role
+		return nil
+	})
+}
+
+// BootstrapRole grants role to the user with the given id, but only while no
+// user holds it yet. It reports whether the role was granted.
+func (db *DB) BootstrapRole(id int, role string) (bool, error) {
+	granted := false
+	err := db.update(func(file *File) error {
+		for _, v := range file.Users {
+			if v.Role == role {
+				return nil
+			}
+		}
+
+		user, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+		user.Role = role
+		file.Users[user.Email] = user
+		granted = true
+		return nil
+	})
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	os.WriteFile(db.path, data, 0666)
-	return nil
+	return granted, nil
+}
 
+// updateUser applies fn to the user with the given id and saves the result.
+func (db *DB) updateUser(id int, fn func(user *User) error) error {
+	return db.update(func(file *File) error {
+		user, ok := file.UserById(id)
+		if !ok {
+			return errors.New("User does not exist")
+		}
+
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
+		file.Users[user.Email] = user
+		return nil
+	})
 }
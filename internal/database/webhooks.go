@@ -0,0 +1,192 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	WebhookPending   = "pending"
+	WebhookProcessed = "processed"
+	WebhookFailed    = "failed"
+)
+
+var ErrWebhookEventNotFound = errors.New("Webhook event not found")
+
+// WebhookEvent is a webhook delivery kept in the inbox, keyed by the id the
+// sender gave the event so redeliveries are only processed once.
+type WebhookEvent struct {
+	ID         string          `json:"id"`
+	Provider   string          `json:"provider"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Status     string          `json:"status"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+	ReceivedAt time.Time       `json:"received_at"`
+	// Deliveries counts how often the sender delivered the event.
+	Deliveries    int        `json:"deliveries"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+}
+
+// ReceiveWebhookEvent adds event to the inbox as pending. An event already
+// in the inbox is left as it is, apart from counting the delivery, and
+// created is false.
+func (db *DB) ReceiveWebhookEvent(event WebhookEvent) (WebhookEvent, bool, error) {
+	created := false
+	err := db.update(func(file *File) error {
+		existing, ok := file.WebhookEvents[event.ID]
+		if ok {
+			existing.Deliveries++
+			file.WebhookEvents[event.ID] = existing
+			event = existing
+			return nil
+		}
+
+		now := time.Now().UTC()
+		event.Status = WebhookPending
+		event.ReceivedAt = now
+		event.NextAttemptAt = now
+		event.Deliveries = 1
+		file.WebhookEvents[event.ID] = event
+		created = true
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, false, err
+	}
+
+	return event, created, nil
+}
+
+// DueWebhookEvents returns the pending events whose next attempt is due,
+// oldest first.
+func (db *DB) DueWebhookEvents(now time.Time) ([]WebhookEvent, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []WebhookEvent{}
+	for _, v := range file.WebhookEvents {
+		if v.Status == WebhookPending && !v.NextAttemptAt.After(now) {
+			events = append(events, v)
+		}
+	}
+	sortWebhookEvents(events)
+
+	return events, nil
+}
+
+// FinishWebhookAttempt records an attempt at processing the event. A nil
+// procErr marks it processed. Otherwise it is retried at retryAt, or marked
+// failed when retryAt is nil.
+func (db *DB) FinishWebhookAttempt(id string, procErr error, retryAt *time.Time) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.WebhookEvents[id]
+		if !ok {
+			return ErrWebhookEventNotFound
+		}
+
+		existing.Attempts++
+		switch {
+		case procErr == nil:
+			now := time.Now().UTC()
+			existing.Status = WebhookProcessed
+			existing.LastError = ""
+			existing.ProcessedAt = &now
+		case retryAt != nil:
+			existing.Status = WebhookPending
+			existing.LastError = procErr.Error()
+			existing.NextAttemptAt = *retryAt
+		default:
+			existing.Status = WebhookFailed
+			existing.LastError = procErr.Error()
+		}
+		file.WebhookEvents[id] = existing
+		event = existing
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+// ListWebhookEvents returns up to limit events with the given status, or of
+// any status when it is empty, most recently received first.
+func (db *DB) ListWebhookEvents(status string, limit int) ([]WebhookEvent, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return nil, err
+	}
+
+	events := []WebhookEvent{}
+	for _, v := range file.WebhookEvents {
+		if status == "" || v.Status == status {
+			events = append(events, v)
+		}
+	}
+	sortWebhookEvents(events)
+	for a, b := 0, len(events)-1; a < b; a, b = a+1, b-1 {
+		events[a], events[b] = events[b], events[a]
+	}
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+func (db *DB) GetWebhookEvent(id string) (WebhookEvent, error) {
+	file, err := db.ReadFile()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	event, ok := file.WebhookEvents[id]
+	if !ok {
+		return WebhookEvent{}, ErrWebhookEventNotFound
+	}
+
+	return event, nil
+}
+
+// ReplayWebhookEvent queues an event to be processed again right away,
+// whatever its status, with a fresh set of attempts.
+func (db *DB) ReplayWebhookEvent(id string) (WebhookEvent, error) {
+	event := WebhookEvent{}
+	err := db.update(func(file *File) error {
+		existing, ok := file.WebhookEvents[id]
+		if !ok {
+			return ErrWebhookEventNotFound
+		}
+
+		existing.Status = WebhookPending
+		existing.Attempts = 0
+		existing.LastError = ""
+		existing.NextAttemptAt = time.Now().UTC()
+		file.WebhookEvents[id] = existing
+		event = existing
+		return nil
+	})
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return event, nil
+}
+
+func sortWebhookEvents(events []WebhookEvent) {
+	sort.Slice(events, func(a, b int) bool {
+		if events[a].ReceivedAt.Equal(events[b].ReceivedAt) {
+			return events[a].ID < events[b].ID
+		}
+		return events[a].ReceivedAt.Before(events[b].ReceivedAt)
+	})
+}
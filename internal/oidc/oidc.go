@@ -0,0 +1,295 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// discoveryLifetime is how long a discovery document is cached.
+	discoveryLifetime = time.Hour
+	// keysRefreshInterval limits how often an unknown kid triggers a JWKS
+	// fetch, so forged tokens cannot make us hammer the provider.
+	keysRefreshInterval = time.Minute
+	leeway              = 30 * time.Second
+)
+
+var (
+	ErrDiscovery      = errors.New("failed to fetch provider configuration")
+	ErrExchange       = errors.New("failed to exchange authorization code")
+	ErrIDTokenInvalid = errors.New("id token is invalid")
+	ErrNonceMismatch  = errors.New("id token nonce does not match")
+)
+
+// supportedAlgs are the ID token signing algorithms accepted when the
+// provider also lists them. Symmetric algorithms and "none" never are.
+var supportedAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+type Config struct {
+	// Name identifies the provider in Chirpy URLs, such as "google".
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the Chirpy callback the provider sends users back to.
+	RedirectURL string
+}
+
+// Discovery holds the members of an OpenID Provider configuration document
+// Chirpy uses.
+type Discovery struct {
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSURI               string   `json:"jwks_uri"`
+	SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// IDToken holds the claims of a verified ID token.
+type IDToken struct {
+	jwt.RegisteredClaims
+	Nonce           string `json:"nonce"`
+	AuthorizedParty string `json:"azp,omitempty"`
+	Email           string `json:"email"`
+	EmailVerified   bool   `json:"email_verified"`
+}
+
+type Provider struct {
+	Config
+	client *http.Client
+
+	mu           sync.Mutex
+	discovery    *Discovery
+	discoveredAt time.Time
+	keys         map[string]crypto.PublicKey
+	keysFetched  time.Time
+}
+
+func NewProvider(cfg Config) *Provider {
+	return &Provider{
+		Config: cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Discover returns the provider configuration, fetching it from the issuer's
+// well-known location when it is not cached.
+func (p *Provider) Discover(ctx context.Context) (*Discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil && time.Since(p.discoveredAt) < discoveryLifetime {
+		return p.discovery, nil
+	}
+
+	d := &Discovery{}
+	err := p.getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+	// the document must be about the issuer we asked, see OpenID Connect
+	// Discovery section 4.3
+	if d.Issuer != p.Issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: document is incomplete or for another issuer", ErrDiscovery)
+	}
+
+	p.discovery = d
+	p.discoveredAt = time.Now()
+	return d, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. state and nonce must be
+// checked once the user returns, codeChallenge is the S256 PKCE challenge.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientID)
+	query.Set("redirect_uri", p.RedirectURL)
+	query.Set("scope", "openid email")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", auth.PKCEMethodS256)
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code at the token endpoint and returns
+// the raw ID token, which must still be verified with VerifyIDToken.
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {codeVerifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrExchange, err)
+	}
+	defer res.Body.Close()
+
+	body := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrExchange, err)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("%w: %s %s", ErrExchange, body.Error, body.ErrorDescription)
+	}
+
+	return body.IDToken, nil
+}
+
+// VerifyIDToken checks the signature and claims of an ID token as OpenID
+// Connect Core section 3.1.3.7 requires, including that it carries nonce.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*IDToken, error) {
+	d, err := p.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	algs := []string{}
+	for _, alg := range supportedAlgs {
+		for _, v := range d.SigningAlgs {
+			if v == alg {
+				algs = append(algs, alg)
+			}
+		}
+	}
+	if len(d.SigningAlgs) == 0 {
+		algs = []string{"RS256"}
+	}
+
+	claims := &IDToken{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, d, kid)
+	},
+		jwt.WithValidMethods(algs),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(leeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIDTokenInvalid, err)
+	}
+
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: sub is missing", ErrIDTokenInvalid)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID {
+		return nil, fmt.Errorf("%w: azp does not match the client id", ErrIDTokenInvalid)
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	return claims, nil
+}
+
+// key returns the provider key with the given kid, refetching the key set
+// when the provider may have rotated its keys.
+func (p *Provider) key(ctx context.Context, d *Discovery, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.keys[kid]; !ok && time.Since(p.keysFetched) > keysRefreshInterval {
+		set := auth.JWKSet{}
+		err := p.getJSON(ctx, d.JWKSURI, &set)
+		if err != nil {
+			return nil, err
+		}
+
+		keys := map[string]crypto.PublicKey{}
+		for _, jwk := range set.Keys {
+			if jwk.Use != "" && jwk.Use != "sig" {
+				continue
+			}
+			key, err := jwk.PublicKey()
+			if err != nil {
+				continue
+			}
+			keys[jwk.Kid] = key
+		}
+		p.keys = keys
+		p.keysFetched = time.Now()
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	// providers publishing a single key may leave out the kid
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+
+	return nil, auth.ErrUnknownKey
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %s", ErrDiscovery, url, res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrDiscovery, err)
+	}
+
+	return nil
+}
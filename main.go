@@ -5,17 +5,72 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
 	"github.com/abi-liu/chirpy/internal/database"
+	"github.com/abi-liu/chirpy/internal/mailer"
+	"github.com/abi-liu/chirpy/internal/oidc"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type apiConfig struct {
 	fileserverHits int
-	UID            int
 	db             *database.DB
-	jwt            string
-	polka          string
+	keys           *auth.Keyring
+	// polkaSecrets sign Polka webhooks, the current secret first followed by
+	// those still accepted during a rotation.
+	polkaSecrets []string
+	// polkaReplayWindow is how far a webhook timestamp may be from now.
+	polkaReplayWindow time.Duration
+	webhookReplays    *replayCache
+	// webhookWake starts the webhook worker early when an event arrives.
+	webhookWake        chan struct{}
+	webhookMaxAttempts int
+	webhookRetryDelay  time.Duration
+	// subscriptionPeriod is how long a Chirpy Red payment lasts when Polka
+	// does not say, subscriptionGrace how long the plan is kept after a
+	// renewal is missed or a payment fails.
+	subscriptionPeriod time.Duration
+	subscriptionGrace  time.Duration
+	// undoWindow is how long a deleted chirp can still be restored, retention
+	// how long it is kept before being purged.
+	undoWindow time.Duration
+	retention  time.Duration
+	views      *viewCounter
+	throttle   *loginThrottle
+	mailer     mailer.Mailer
+	// publicURL is the address the server is reached at, used in emailed
+	// links.
+	publicURL                string
+	requireEmailVerification bool
+	passwordPolicy           *auth.PasswordPolicy
+	// oidcProviders are the external identity providers users can log in
+	// with, keyed by name.
+	oidcProviders map[string]*oidc.Provider
+	oidcLogins    *oidcLogins
+	// adminBootstrapEmail is made the first admin once verified.
+	adminBootstrapEmail string
+	audit               *audit.Log
+	auditRetention      time.Duration
+}
+
+// appFiles serves the web app, index.html and the assets directory, out of
+// the working directory without exposing anything else kept there, like
+// database.json or the audit log.
+type appFiles struct {
+	dir http.Dir
+}
+
+func (f appFiles) Open(name string) (http.File, error) {
+	if name != "/" && name != "/index.html" && name != "/assets" && !strings.HasPrefix(name, "/assets/") {
+		return nil, os.ErrNotExist
+	}
+	return f.dir.Open(name)
 }
 
 func createUIDClosure() func() int {
@@ -32,11 +87,64 @@ func main() {
 		log.Fatal("Failed to load env")
 	}
 	jwtSecret := os.Getenv("JWT_SECRET")
-	polkaSecret := os.Getenv("POLKA_SECRET")
+	keys := auth.NewHMACKeyring(jwtSecret)
+	if path := os.Getenv("JWT_SIGNING_KEY"); path != "" {
+		keys, err = auth.LoadKeyring(path, splitList(os.Getenv("JWT_VERIFICATION_KEYS")), jwtSecret)
+		if err != nil {
+			log.Fatalf("Failed to load signing keys: %s", err)
+		}
+	}
 	mux := http.NewServeMux()
-	appConfig := &apiConfig{}
-	appConfig.jwt = jwtSecret
-	appConfig.polka = polkaSecret
+	appConfig := &apiConfig{views: newViewCounter(), throttle: newLoginThrottle(), keys: keys}
+	appConfig.polkaSecrets = append(splitList(os.Getenv("POLKA_SECRET")), splitList(os.Getenv("POLKA_PREVIOUS_SECRETS"))...)
+	if len(appConfig.polkaSecrets) == 0 {
+		log.Print("POLKA_SECRET is not set, Polka webhooks will be refused")
+	}
+	appConfig.polkaReplayWindow = durationFromEnv("POLKA_REPLAY_WINDOW", 5*time.Minute)
+	appConfig.webhookReplays = newReplayCache()
+	appConfig.webhookWake = make(chan struct{}, 1)
+	appConfig.webhookMaxAttempts = intFromEnv("WEBHOOK_MAX_ATTEMPTS", 8)
+	appConfig.webhookRetryDelay = durationFromEnv("WEBHOOK_RETRY_DELAY", 30*time.Second)
+	appConfig.subscriptionPeriod = durationFromEnv("SUBSCRIPTION_PERIOD", 30*24*time.Hour)
+	appConfig.subscriptionGrace = durationFromEnv("SUBSCRIPTION_GRACE_PERIOD", 3*24*time.Hour)
+	appConfig.undoWindow = durationFromEnv("CHIRP_UNDO_WINDOW", 5*time.Minute)
+	appConfig.retention = durationFromEnv("CHIRP_RETENTION", 30*24*time.Hour)
+	appConfig.publicURL = strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if appConfig.publicURL == "" {
+		appConfig.publicURL = "http://localhost:8080"
+	}
+	appConfig.requireEmailVerification = os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+	appConfig.adminBootstrapEmail = os.Getenv("ADMIN_BOOTSTRAP_EMAIL")
+	auditPath := os.Getenv("AUDIT_LOG_PATH")
+	if auditPath == "" {
+		auditPath = "audit.log"
+	}
+	appConfig.audit = audit.NewLog(auditPath)
+	appConfig.auditRetention = durationFromEnv("AUDIT_RETENTION", 365*24*time.Hour)
+	appConfig.oidcProviders = loadOIDCProviders(appConfig.publicURL)
+	appConfig.oidcLogins = newOIDCLogins()
+	appConfig.mailer = mailer.NewLogMailer(os.Getenv("MAIL_LOG_PATH"))
+	if os.Getenv("MAILER") == "smtp" {
+		appConfig.mailer = mailer.NewSMTPMailer(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+
+	// bcrypt ignores everything past 72 bytes, so longer passwords are only
+	// accepted when hashing with Argon2id
+	hasher := database.PasswordHasher{
+		Algorithm:  database.AlgorithmBcrypt,
+		BcryptCost: intFromEnv("BCRYPT_COST", bcrypt.DefaultCost),
+		Argon2:     database.DefaultArgon2Params,
+	}
+	maxPasswordLength := 72
+	if os.Getenv("PASSWORD_HASHER") == database.AlgorithmArgon2id {
+		hasher.Algorithm = database.AlgorithmArgon2id
+		maxPasswordLength = 256
+	}
+	database.SetPasswordHasher(hasher)
+	appConfig.passwordPolicy, err = auth.NewPasswordPolicy(intFromEnv("PASSWORD_MIN_LENGTH", 8), maxPasswordLength, os.Getenv("PASSWORD_BREACHED_LIST"))
+	if err != nil {
+		log.Fatalf("Failed to load breached password list: %s", err)
+	}
 
 	db, err := database.CreateDB("database.json")
 	if err != nil {
@@ -44,20 +152,83 @@ func main() {
 	}
 	appConfig.db = db
 
-	mux.Handle("/app/", appConfig.middlewareMetricsInc(http.StripPrefix("/app/", http.FileServer(http.Dir(".")))))
+	go appConfig.purgeDeletedChirps(durationFromEnv("CHIRP_PURGE_INTERVAL", time.Hour))
+	go appConfig.flushChirpViews(durationFromEnv("CHIRP_VIEWS_FLUSH_INTERVAL", time.Minute))
+	go appConfig.pruneAuditLog(durationFromEnv("AUDIT_PRUNE_INTERVAL", 24*time.Hour))
+	go appConfig.processWebhookEvents(durationFromEnv("WEBHOOK_POLL_INTERVAL", 10*time.Second))
+	go appConfig.expireSubscriptions(durationFromEnv("SUBSCRIPTION_EXPIRY_INTERVAL", time.Hour))
+	go appConfig.pruneLoginThrottle(durationFromEnv("LOGIN_THROTTLE_PRUNE_INTERVAL", 10*time.Minute))
+
+	mux.Handle("/app/", appConfig.middlewareMetricsInc(http.StripPrefix("/app/", http.FileServer(appFiles{dir: http.Dir(".")}))))
 	mux.HandleFunc("GET /api/healthz", getHealthCheck)
-	mux.HandleFunc("GET /admin/metrics", appConfig.getMetrics)
-	mux.HandleFunc("GET /api/reset", appConfig.resetMetrics)
-	mux.HandleFunc("POST /api/chirps", appConfig.postChirp)
-	mux.HandleFunc("GET /api/chirps", appConfig.getChirps)
-	mux.HandleFunc("GET /api/chirps/{id}", appConfig.getChirpById)
-	mux.HandleFunc("DELETE /api/chirps/{id}", appConfig.deleteChirpById)
+	mux.HandleFunc("GET /.well-known/jwks.json", appConfig.getJWKS)
+	mux.Handle("GET /admin/metrics", appConfig.requireAuth(requirePermission(auth.PermViewMetrics, appConfig.getMetrics)))
+	mux.Handle("GET /api/reset", appConfig.requireAuth(requirePermission(auth.PermResetMetrics, appConfig.resetMetrics)))
+	mux.Handle("GET /admin/lockouts", appConfig.requireAuth(requirePermission(auth.PermManageLockouts, appConfig.getLockouts)))
+	mux.Handle("DELETE /admin/lockouts", appConfig.requireAuth(requirePermission(auth.PermManageLockouts, appConfig.clearLockout)))
+	mux.Handle("PUT /api/admin/users/{id}/role", appConfig.requireAuth(requirePermission(auth.PermManageRoles, appConfig.setUserRole)))
+	mux.Handle("GET /api/admin/audit", appConfig.requireAuth(requirePermission(auth.PermViewAudit, appConfig.getAuditEvents)))
+	mux.Handle("GET /api/admin/audit/export", appConfig.requireAuth(requirePermission(auth.PermViewAudit, appConfig.exportAuditEvents)))
+	mux.Handle("GET /api/admin/webhooks", appConfig.requireAuth(requirePermission(auth.PermManageWebhooks, appConfig.getWebhookEvents)))
+	mux.Handle("GET /api/admin/webhooks/{id}", appConfig.requireAuth(requirePermission(auth.PermManageWebhooks, appConfig.getWebhookEvent)))
+	mux.Handle("POST /api/admin/webhooks/{id}/replay", appConfig.requireAuth(requirePermission(auth.PermManageWebhooks, appConfig.replayWebhookEvent)))
+	mux.Handle("GET /api/admin/users", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.listUsers)))
+	mux.Handle("GET /api/admin/users/{id}", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.getUser)))
+	mux.Handle("POST /api/admin/users/{id}/suspend", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.suspendUser)))
+	mux.Handle("POST /api/admin/users/{id}/unsuspend", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.unsuspendUser)))
+	mux.Handle("POST /api/admin/users/{id}/password-reset", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.forcePasswordReset)))
+	mux.Handle("PUT /api/admin/users/{id}/chirpy-red", appConfig.requireAuth(requirePermission(auth.PermManageUsers, appConfig.setChirpyRed)))
+	mux.Handle("POST /api/admin/users/{id}/impersonate", appConfig.requireAuth(requirePermission(auth.PermImpersonate, appConfig.impersonateUser)))
+	mux.Handle("POST /api/chirps", appConfig.requireAuth(requireScope(auth.ScopeChirpsWrite, appConfig.requireVerifiedEmail(appConfig.postChirp))))
+	mux.Handle("POST /api/chirps:batch", appConfig.requireAuth(requireScope(auth.ScopeChirpsWrite, appConfig.requireVerifiedEmail(appConfig.batchChirps))))
+	mux.Handle("GET /api/chirps", appConfig.optionalAuth(requireScope(auth.ScopeChirpsRead, appConfig.getChirps)))
+	mux.Handle("GET /api/chirps/{id}", appConfig.optionalAuth(requireScope(auth.ScopeChirpsRead, appConfig.getChirpById)))
+	mux.Handle("DELETE /api/chirps/{id}", appConfig.requireAuth(requireScope(auth.ScopeChirpsWrite, appConfig.deleteChirpById)))
+	mux.Handle("POST /api/chirps/{id}/restore", appConfig.requireAuth(requireScope(auth.ScopeChirpsWrite, appConfig.restoreChirp)))
+	mux.Handle("PUT /api/chirps/{id}/content-warning", appConfig.requireAuth(requireScope(auth.ScopeChirpsWrite, appConfig.updateContentWarning)))
 	mux.HandleFunc("POST /api/users", appConfig.createUser)
 	mux.HandleFunc("POST /api/login", appConfig.login)
-	mux.HandleFunc("PUT /api/users", appConfig.updateUserCredentials)
+	mux.HandleFunc("POST /api/login/mfa", appConfig.loginMFA)
+	mux.HandleFunc("GET /api/oidc/{provider}/login", appConfig.startOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/{provider}/callback", appConfig.finishOIDCLogin)
+	mux.Handle("POST /api/mfa/totp/enroll", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.enrollTOTP)))
+	mux.Handle("POST /api/mfa/totp/confirm", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.confirmTOTP)))
+	mux.Handle("DELETE /api/mfa/totp", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.disableTOTP)))
+	mux.Handle("PUT /api/users/me/password", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.changePassword)))
+	mux.Handle("POST /api/users/me/email", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.requestEmailChange)))
+	mux.HandleFunc("POST /api/users/me/email/confirm", appConfig.confirmEmailChange)
+	mux.HandleFunc("POST /api/password-reset", appConfig.requestPasswordReset)
+	mux.HandleFunc("POST /api/password-reset/confirm", appConfig.confirmPasswordReset)
+	mux.Handle("POST /api/users/verify-email/request", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.requestEmailVerification)))
+	mux.HandleFunc("POST /api/users/verify-email", appConfig.verifyEmail)
 	mux.HandleFunc("POST /api/refresh", appConfig.refreshToken)
 	mux.HandleFunc("POST /api/revoke", appConfig.revokeToken)
+	mux.Handle("GET /api/sessions", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.getSessions)))
+	mux.Handle("DELETE /api/sessions", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.revokeAllSessions)))
+	mux.Handle("DELETE /api/sessions/{id}", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.revokeSession)))
+	mux.Handle("POST /api/keys", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.createAPIKey)))
+	mux.Handle("GET /api/keys", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.getAPIKeys)))
+	mux.Handle("DELETE /api/keys/{id}", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.revokeAPIKey)))
+	mux.Handle("POST /api/oauth/clients", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.registerOAuthClient)))
+	mux.Handle("GET /api/oauth/clients", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.getOAuthClients)))
+	mux.Handle("DELETE /api/oauth/clients/{id}", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.deleteOAuthClient)))
+	mux.HandleFunc("GET /api/oauth/authorize", appConfig.authorize)
+	mux.HandleFunc("POST /api/oauth/authorize", appConfig.approveAuthorization)
+	mux.HandleFunc("POST /api/oauth/token", appConfig.issueToken)
+	mux.HandleFunc("POST /api/oauth/revoke", appConfig.revokeClientToken)
+	mux.HandleFunc("POST /api/oauth/introspect", appConfig.introspectToken)
 	mux.HandleFunc("POST /api/polka/webhooks", appConfig.receiveWebhook)
+	mux.Handle("DELETE /api/users/me", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.deleteAccount)))
+	mux.Handle("GET /api/users/me/export", appConfig.requireAuth(requireScope(auth.ScopeAll, appConfig.exportAccount)))
+	mux.Handle("PUT /api/users/me/privacy", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.updatePrivacy)))
+	mux.Handle("PUT /api/users/me/preferences", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.updatePreferences)))
+	mux.Handle("GET /api/users/me/subscription", appConfig.requireAuth(requireScope(auth.ScopeProfileRead, appConfig.getSubscription)))
+	mux.Handle("GET /api/users/me/analytics", appConfig.requireAuth(requireScope(auth.ScopeProfileRead, appConfig.getAnalytics)))
+	mux.Handle("POST /api/users/{id}/follow", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.followUser)))
+	mux.Handle("DELETE /api/users/{id}/follow", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.unfollowUser)))
+	mux.Handle("GET /api/follow-requests", appConfig.requireAuth(requireScope(auth.ScopeProfileRead, appConfig.getFollowRequests)))
+	mux.Handle("POST /api/follow-requests/{id}/approve", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.approveFollowRequest)))
+	mux.Handle("DELETE /api/follow-requests/{id}", appConfig.requireAuth(requireScope(auth.ScopeProfileWrite, appConfig.rejectFollowRequest)))
 
 	server := &http.Server{Addr: ":8080", Handler: mux}
 
@@ -65,6 +236,52 @@ func main() {
 	log.Fatal(server.ListenAndServe())
 }
 
+// durationFromEnv parses an environment variable such as "90s" or "720h",
+// falling back to def when it is unset or invalid.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, def)
+		return def
+	}
+
+	return d
+}
+
+// intFromEnv parses an integer environment variable, falling back to def when
+// it is unset or invalid.
+func intFromEnv(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid number %q for %s, using %d", value, key, def)
+		return def
+	}
+
+	return n
+}
+
+// splitList splits a comma-separated environment variable, dropping empty
+// entries.
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 func getHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -98,3 +315,10 @@ func (c *apiConfig) resetMetrics(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(http.StatusText(http.StatusOK)))
 }
+
+// getJWKS publishes the public keys tokens are verified with, so other
+// services can verify Chirpy tokens without holding a secret.
+func (c *apiConfig) getJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, http.StatusOK, c.keys.JWKS())
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+const recoveryCodeCount = 10
+
+func (c *apiConfig) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Res struct {
+		Secret     string `json:"secret"`
+		OtpauthURI string `json:"otpauth_uri"`
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate secret")
+		return
+	}
+
+	err = c.db.SetPendingTOTPSecret(userId, secret)
+	if errors.Is(err, database.ErrTOTPAlreadyEnabled) {
+		respondWithError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{
+		Secret:     secret,
+		OtpauthURI: auth.TOTPProvisioningURI(secret, user.Email),
+	})
+}
+
+// confirmTOTP turns two-factor authentication on once the user proved their
+// authenticator generates valid codes, and hands out the recovery codes. They
+// are only ever shown here, the database keeps their hashes.
+func (c *apiConfig) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Req struct {
+		Code string `json:"code"`
+	}
+	type Res struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+	if user.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, database.ErrTOTPAlreadyEnabled.Error())
+		return
+	}
+	if user.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, database.ErrTOTPNotEnrolled.Error())
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, req.Code, time.Now(), 0)
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate recovery codes")
+		return
+	}
+
+	hashes := []string{}
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashRecoveryCode(code))
+	}
+
+	err = c.db.EnableTOTP(userId, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionMFAEnable, Outcome: audit.OutcomeSuccess})
+
+	respondWithJSON(w, http.StatusOK, Res{RecoveryCodes: codes})
+}
+
+func (c *apiConfig) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Req struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, "User does not exist")
+		return
+	}
+	if !user.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, database.ErrTOTPNotEnrolled.Error())
+		return
+	}
+
+	err = c.verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.recordEvent(r, audit.Event{Action: actionMFADisable, Outcome: audit.OutcomeFailure, Detail: err.Error()})
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = c.db.DisableTOTP(userId)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionMFADisable, Outcome: audit.OutcomeSuccess})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// loginMFA completes a two-step login, exchanging the challenge token from
+// POST /api/login and a TOTP or recovery code for access and refresh tokens.
+func (c *apiConfig) loginMFA(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		MFAToken         string `json:"mfa_token"`
+		Code             string `json:"code"`
+		RecoveryCode     string `json:"recovery_code"`
+		ExpiresInSeconds int    `json:"expires_in_seconds"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	userId, err := auth.ParseMFAToken(req.MFAToken, c.keys)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "MFA token is invalid or expired")
+		return
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil || !user.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "MFA token is invalid or expired")
+		return
+	}
+
+	// wrong codes count towards the same lockout as wrong passwords
+	account, ip := accountKey(user.Email), ipKey(r)
+	if wait := c.throttle.lockedFor(account, ip); wait > 0 {
+		c.recordLogin(r, user.ID, "second factor", errLockedOut)
+		respondLockedOut(w, wait)
+		return
+	}
+
+	err = c.verifySecondFactor(user, req.Code, req.RecoveryCode)
+	if err != nil {
+		c.throttle.recordFailure(account, ip)
+		c.recordLogin(r, user.ID, "second factor", err)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	c.throttle.reset(account)
+
+	// the account may have been suspended since the password was checked
+	err = accountStatus(user)
+	if err != nil {
+		c.recordLogin(r, user.ID, "second factor", err)
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	c.recordLogin(r, user.ID, "password and second factor", nil)
+	c.startSession(w, r, user, req.ExpiresInSeconds)
+}
+
+var errInvalidCode = errors.New("Invalid code")
+
+// verifySecondFactor checks a TOTP code, or consumes a recovery code when no
+// TOTP code is given.
+func (c *apiConfig) verifySecondFactor(user database.User, code, recoveryCode string) error {
+	if code == "" && recoveryCode != "" {
+		err := c.db.UseRecoveryCode(user.ID, auth.HashRecoveryCode(recoveryCode))
+		if err != nil {
+			return database.ErrRecoveryCodeInvalid
+		}
+		return nil
+	}
+
+	step, ok := auth.ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return errInvalidCode
+	}
+
+	// recording the step fails if a concurrent request used the same code
+	err := c.db.RecordTOTPStep(user.ID, step)
+	if err != nil {
+		return database.ErrTOTPCodeReused
+	}
+
+	return nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+var (
+	errTokenMissing       = errors.New("Token not provided")
+	errAuthHeaderFormat   = errors.New("Authorization header must use the Bearer scheme")
+	errUnknownUser        = errors.New("Token subject does not exist")
+	errSessionRevoked     = errors.New("Session has been revoked")
+	errAPIKeyInvalid      = errors.New("API key is invalid")
+	errImpersonationEnded = errors.New("Impersonation is no longer allowed")
+)
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>"
+// header.
+func bearerToken(r *http.Request) (string, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", errTokenMissing
+	}
+
+	scheme, token, ok := strings.Cut(authHeader, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errAuthHeaderFormat
+	}
+
+	return strings.TrimSpace(token), nil
+}
+
+// authenticate validates the bearer JWT or API key of r and resolves its
+// principal.
+func (c *apiConfig) authenticate(r *http.Request) (auth.Principal, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+
+	if auth.IsAPIKey(token) {
+		return c.authenticateAPIKey(token)
+	}
+
+	claims, err := auth.ParseToken(token, c.keys)
+	if err != nil {
+		return auth.Principal{}, err
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return auth.Principal{}, auth.ErrTokenInvalidClaims
+	}
+
+	user, err := c.db.FindUserById(id)
+	if err != nil {
+		return auth.Principal{}, errUnknownUser
+	}
+	if user.SuspendedAt != nil {
+		return auth.Principal{}, errAccountSuspended
+	}
+
+	// revoking a session also revokes the access tokens issued for it
+	if claims.SessionID != "" {
+		_, err = c.db.LookupSession(claims.SessionID)
+		if err != nil {
+			return auth.Principal{}, errSessionRevoked
+		}
+	}
+
+	principal := newPrincipal(user, claims.Scopes(), claims.SessionID)
+	principal.ClientID = claims.ClientID
+	if claims.Actor != nil {
+		principal.ImpersonatorID, err = c.checkImpersonator(claims.Actor)
+		if err != nil {
+			return auth.Principal{}, err
+		}
+		c.recordEvent(r, audit.Event{
+			ActorID:        user.ID,
+			ImpersonatorID: principal.ImpersonatorID,
+			Action:         actionImpersonatedRequest,
+			Outcome:        audit.OutcomeSuccess,
+			Detail:         r.Method + " " + r.URL.Path,
+		})
+	}
+	return principal, nil
+}
+
+// checkImpersonator makes sure the admin behind an impersonation token may
+// still impersonate, so demoting or suspending them ends it at once.
+func (c *apiConfig) checkImpersonator(actor *auth.Actor) (int, error) {
+	id, err := strconv.Atoi(actor.Subject)
+	if err != nil {
+		return 0, auth.ErrTokenInvalidClaims
+	}
+
+	admin, err := c.db.FindUserById(id)
+	if err != nil || admin.SuspendedAt != nil || !auth.RoleHasPermission(userRole(admin), auth.PermImpersonate) {
+		return 0, errImpersonationEnded
+	}
+
+	return id, nil
+}
+
+// authenticateAPIKey resolves the principal of a personal API key, which only
+// holds the scopes the key was created with.
+func (c *apiConfig) authenticateAPIKey(token string) (auth.Principal, error) {
+	key, err := c.db.LookupAPIKey(auth.HashAPIKey(token))
+	if errors.Is(err, database.ErrAPIKeyExpired) {
+		return auth.Principal{}, err
+	}
+	if err != nil {
+		return auth.Principal{}, errAPIKeyInvalid
+	}
+
+	user, err := c.db.FindUserById(key.UserId)
+	if err != nil {
+		return auth.Principal{}, errUnknownUser
+	}
+	if user.SuspendedAt != nil {
+		return auth.Principal{}, errAccountSuspended
+	}
+
+	return newPrincipal(user, key.Scopes, ""), nil
+}
+
+func newPrincipal(user database.User, scopes []string, sessionId string) auth.Principal {
+	tier := auth.TierFree
+	if user.IsChirpyRed {
+		tier = auth.TierRed
+	}
+
+	return auth.Principal{
+		UserID:        user.ID,
+		Tier:          tier,
+		Role:          userRole(user),
+		Scopes:        scopes,
+		SessionID:     sessionId,
+		EmailVerified: user.EmailVerified,
+	}
+}
+
+// userRole returns the role of user, users without one are regular users.
+func userRole(user database.User) string {
+	if user.Role == "" {
+		return auth.RoleUser
+	}
+	return user.Role
+}
+
+// requireAuth only lets requests with a valid bearer JWT or API key through
+// to next, which can read the caller with requestPrincipal.
+func (c *apiConfig) requireAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := c.authenticate(r)
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// optionalAuth serves anonymous requests as well, but still rejects requests
+// that carry a token which is not valid.
+func (c *apiConfig) optionalAuth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := c.authenticate(r)
+		if errors.Is(err, errTokenMissing) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithPrincipal(r.Context(), principal)))
+	})
+}
+
+// requireVerifiedEmail rejects callers who have not verified their email when
+// the server is configured to require it. It must be wrapped by requireAuth.
+func (c *apiConfig) requireVerifiedEmail(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c.requireEmailVerification && !requestPrincipal(r).EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Please verify your email address first")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireScope rejects authenticated callers whose credentials lack scope.
+// Anonymous callers let through by optionalAuth are not affected.
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, ok := auth.PrincipalFromContext(r.Context())
+		if ok && !principal.HasScope(scope) {
+			msg := fmt.Sprintf("Credentials lack the %s scope", scope)
+			if scope == auth.ScopeAll {
+				msg = "API keys cannot be used for this endpoint"
+			}
+			if scope == auth.ScopeAll && principal.ImpersonatorID != 0 {
+				msg = "Impersonation tokens cannot be used for this endpoint"
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="chirpy", error="insufficient_scope", scope=%q`, scope))
+			respondWithError(w, http.StatusForbidden, msg)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requirePermission only lets callers whose role grants permission through to
+// next. It must be wrapped in requireAuth.
+func requirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := requestPrincipal(r)
+		if !principal.HasPermission(permission) {
+			respondWithError(w, http.StatusForbidden, "You are not allowed to do this")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requestPrincipal returns the caller placed in the context by requireAuth or
+// optionalAuth, anonymous callers get a principal with a UserID of 0.
+func requestPrincipal(r *http.Request) auth.Principal {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	return principal
+}
+
+// respondWithAuthError answers a failed authentication following RFC 6750.
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	const realm = `Bearer realm="chirpy"`
+
+	switch {
+	case errors.Is(err, errTokenMissing):
+		w.Header().Set("WWW-Authenticate", realm)
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	case errors.Is(err, errAuthHeaderFormat):
+		w.Header().Set("WWW-Authenticate", realm+`, error="invalid_request"`)
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	msg := "Token is invalid"
+	switch {
+	case errors.Is(err, auth.ErrTokenExpired):
+		msg = "Token expired"
+	case errors.Is(err, auth.ErrTokenNotYetValid):
+		msg = "Token is not valid yet"
+	case errors.Is(err, auth.ErrTokenBadSignature):
+		msg = "Token signature is invalid"
+	case errors.Is(err, auth.ErrTokenMalformed):
+		msg = "Token is malformed"
+	case errors.Is(err, auth.ErrTokenInvalidClaims):
+		msg = "Token claims are invalid"
+	case errors.Is(err, errUnknownUser), errors.Is(err, errSessionRevoked),
+		errors.Is(err, errAPIKeyInvalid), errors.Is(err, database.ErrAPIKeyExpired),
+		errors.Is(err, errAccountSuspended), errors.Is(err, errImpersonationEnded):
+		msg = err.Error()
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`%s, error="invalid_token", error_description=%q`, realm, msg))
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
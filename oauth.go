@@ -0,0 +1,745 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+const (
+	authorizationCodeLifetime = 5 * time.Minute
+	oauthAccessTokenLifetime  = 60 * 60
+	maxRedirectURIs           = 10
+)
+
+// scopeDescriptions explain each scope on the consent screen.
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead:   "Read chirps you can see",
+	auth.ScopeChirpsWrite:  "Post and delete chirps as you",
+	auth.ScopeProfileRead:  "Read your follow requests and analytics",
+	auth.ScopeProfileWrite: "Change your profile settings and who you follow",
+}
+
+var consentTemplate = template.Must(template.New("consent").Parse(`<html>
+
+<body>
+    <h1>Authorize {{.Client.Name}}</h1>
+    <p>{{.Client.Name}} would like to:</p>
+    <ul>
+        {{range .Scopes}}<li>{{.}}</li>{{end}}
+    </ul>
+    {{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+    <form method="post" action="/api/oauth/authorize">
+        <input type="hidden" name="response_type" value="code">
+        <input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+        <input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+        <input type="hidden" name="scope" value="{{.Request.Scope}}">
+        <input type="hidden" name="state" value="{{.Request.State}}">
+        <input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+        <input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+        <p><label>Email <input type="email" name="email" required></label></p>
+        <p><label>Password <input type="password" name="password" required></label></p>
+        <p><label>Two-factor code, if enabled <input type="text" name="code" autocomplete="one-time-code"></label></p>
+        <button type="submit" name="decision" value="approve">Allow</button>
+        <button type="submit" name="decision" value="deny" formnovalidate>Deny</button>
+    </form>
+</body>
+
+</html>`))
+
+// authorizationRequest holds the parameters of an authorization request, see
+// RFC 6749 section 4.1.1 and RFC 7636 section 4.3.
+type authorizationRequest struct {
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	client database.OAuthClient
+	scopes []string
+}
+
+// oauthError is an error returned to OAuth clients, Code is one of the error
+// codes of RFC 6749.
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e *oauthError) Error() string {
+	return e.Description
+}
+
+// parseAuthorizationRequest validates an authorization request. A non-nil
+// error means the client or redirect URI cannot be trusted, so the user must
+// not be sent back to it. Other problems are reported in the returned
+// oauthError, to be passed on to the client through its redirect URI.
+func (c *apiConfig) parseAuthorizationRequest(values url.Values) (authorizationRequest, *oauthError, error) {
+	req := authorizationRequest{
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+
+	client, err := c.db.GetOAuthClient(req.ClientID)
+	if err != nil {
+		return req, nil, errors.New("Unknown client")
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return req, nil, errors.New("Redirect URI is not registered for this client")
+	}
+	req.client = client
+
+	if values.Get("response_type") != "code" {
+		return req, &oauthError{"unsupported_response_type", "Only the authorization code flow is supported"}, nil
+	}
+
+	req.scopes = strings.Fields(req.Scope)
+	if len(req.scopes) == 0 {
+		req.scopes = client.Scopes
+		req.Scope = strings.Join(client.Scopes, " ")
+	}
+	if !isSubset(req.scopes, client.Scopes) {
+		return req, &oauthError{"invalid_scope", "Requested scope is not allowed for this client"}, nil
+	}
+
+	// PKCE is required of every client, as recommended by RFC 9700
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != auth.PKCEMethodS256 {
+		return req, &oauthError{"invalid_request", "A code_challenge using the S256 method is required"}, nil
+	}
+
+	return req, nil, nil
+}
+
+func isSubset(scopes, granted []string) bool {
+	for _, scope := range scopes {
+		ok := false
+		for _, v := range granted {
+			if v == scope {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// redirectToClient sends the user agent back to the client's redirect URI
+// with params added to its query.
+func redirectToClient(w http.ResponseWriter, r *http.Request, req authorizationRequest, params url.Values) {
+	uri, err := url.Parse(req.RedirectURI)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid redirect URI")
+		return
+	}
+
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	query := uri.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	uri.RawQuery = query.Encode()
+
+	http.Redirect(w, r, uri.String(), http.StatusFound)
+}
+
+func redirectWithOAuthError(w http.ResponseWriter, r *http.Request, req authorizationRequest, oauthErr *oauthError) {
+	redirectToClient(w, r, req, url.Values{
+		"error":             {oauthErr.Code},
+		"error_description": {oauthErr.Description},
+	})
+}
+
+// renderConsent shows the consent screen, where the user logs in and decides
+// whether to grant the client's request.
+func renderConsent(w http.ResponseWriter, status int, req authorizationRequest, errorMessage string) {
+	scopes := []string{}
+	for _, scope := range req.scopes {
+		scopes = append(scopes, scopeDescriptions[scope])
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the consent screen must not be framed, or clicks could be hijacked
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	err := consentTemplate.Execute(w, map[string]any{
+		"Client":  req.client,
+		"Request": req,
+		"Scopes":  scopes,
+		"Error":   errorMessage,
+	})
+	if err != nil {
+		log.Printf("Failed to render consent screen: %s", err)
+	}
+}
+
+// authorize starts the authorization code flow at the consent screen.
+func (c *apiConfig) authorize(w http.ResponseWriter, r *http.Request) {
+	req, oauthErr, err := c.parseAuthorizationRequest(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if oauthErr != nil {
+		redirectWithOAuthError(w, r, req, oauthErr)
+		return
+	}
+
+	renderConsent(w, http.StatusOK, req, "")
+}
+
+// approveAuthorization handles the consent form. Once the user logged in and
+// approved, the client receives an authorization code at its redirect URI.
+func (c *apiConfig) approveAuthorization(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	req, oauthErr, err := c.parseAuthorizationRequest(r.PostForm)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if oauthErr != nil {
+		redirectWithOAuthError(w, r, req, oauthErr)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "approve" {
+		redirectWithOAuthError(w, r, req, &oauthError{"access_denied", "The user denied the request"})
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	detail := "consent for client " + req.client.ID
+	user, wait, err := c.checkPassword(r, email, r.PostForm.Get("password"))
+	if wait > 0 {
+		c.recordLogin(r, 0, detail+" as "+email, errLockedOut)
+		renderConsent(w, http.StatusTooManyRequests, req, "Too many failed attempts, try again later")
+		return
+	}
+	if err != nil {
+		c.recordLogin(r, user.ID, detail+" as "+email, err)
+		renderConsent(w, accountStatusCode(err), req, err.Error())
+		return
+	}
+
+	if user.TOTPEnabled {
+		err = c.verifySecondFactor(user, r.PostForm.Get("code"), "")
+		if err != nil {
+			c.throttle.recordFailure(accountKey(user.Email), ipKey(r))
+			c.recordLogin(r, user.ID, detail, err)
+			renderConsent(w, http.StatusUnauthorized, req, "Invalid two-factor code")
+			return
+		}
+	}
+	c.throttle.reset(accountKey(user.Email))
+	c.recordLogin(r, user.ID, detail, nil)
+
+	code, err := auth.GenerateAuthorizationCode()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate authorization code")
+		return
+	}
+
+	err = c.db.CreateAuthorizationCode(database.AuthorizationCode{
+		Code:          code,
+		ClientId:      req.client.ID,
+		UserId:        user.ID,
+		RedirectURI:   req.RedirectURI,
+		Scopes:        req.scopes,
+		CodeChallenge: req.CodeChallenge,
+		ExpiresAt:     time.Now().UTC().Add(authorizationCodeLifetime),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to save authorization code")
+		return
+	}
+
+	c.recordEvent(r, audit.Event{
+		ActorID: user.ID,
+		Action:  actionOAuthAuthorize,
+		Outcome: audit.OutcomeSuccess,
+		Detail:  "client " + req.client.ID + " granted " + strings.Join(req.scopes, " "),
+	})
+
+	redirectToClient(w, r, req, url.Values{"code": {code}})
+}
+
+// respondWithOAuthError answers a request to the token, revocation or
+// introspection endpoints in the format of RFC 6749 section 5.2.
+func respondWithOAuthError(w http.ResponseWriter, code int, oauthErr *oauthError) {
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, map[string]string{
+		"error":             oauthErr.Code,
+		"error_description": oauthErr.Description,
+	})
+}
+
+var errInvalidClient = &oauthError{"invalid_client", "Client authentication failed"}
+
+// authenticateClient identifies the client calling a token endpoint, from
+// HTTP Basic credentials or the client_id and client_secret form parameters.
+// Confidential clients must present their secret.
+func (c *apiConfig) authenticateClient(r *http.Request) (database.OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if ok {
+		// RFC 6749 section 2.3.1 form-encodes the credentials first
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := c.db.GetOAuthClient(id)
+	if err != nil {
+		return database.OAuthClient{}, errInvalidClient
+	}
+	if client.Confidential() && !auth.CheckClientSecret(secret, client.SecretHash) {
+		return database.OAuthClient{}, errInvalidClient
+	}
+
+	return client, nil
+}
+
+// issueToken exchanges an authorization code or a refresh token for an
+// access token, see RFC 6749 sections 4.1.3 and 6.
+func (c *apiConfig) issueToken(w http.ResponseWriter, r *http.Request) {
+	type Res struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, &oauthError{"invalid_request", "Could not decode request"})
+		return
+	}
+
+	client, err := c.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, errInvalidClient)
+		return
+	}
+
+	refreshToken, err := auth.GenerateRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate refresh token")
+		return
+	}
+
+	var session database.Session
+	scopes := []string{}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		session, err = c.redeemAuthorizationCode(r, client, refreshToken)
+		scopes = session.Scopes
+	case "refresh_token":
+		requested := strings.Fields(r.PostForm.Get("scope"))
+		session, err = c.rotateClientRefreshToken(r, client, refreshToken, requested)
+		scopes = session.Scopes
+		if len(requested) > 0 {
+			scopes = requested
+		}
+	default:
+		err = &oauthError{"unsupported_grant_type", "Only the authorization_code and refresh_token grants are supported"}
+	}
+	oauthErr := &oauthError{}
+	if errors.As(err, &oauthErr) {
+		respondWithOAuthError(w, http.StatusBadRequest, oauthErr)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	accessToken, err := auth.GenerateClientToken(c.keys, session.UserId, oauthAccessTokenLifetime, session.ID, client.ID, scopes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate access token")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, http.StatusOK, Res{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    oauthAccessTokenLifetime,
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
+
+var errInvalidGrant = &oauthError{"invalid_grant", "Authorization grant is invalid, expired or revoked"}
+
+// redeemAuthorizationCode checks an authorization code against the client,
+// redirect URI and PKCE verifier it was issued for, and starts a session
+// for the client.
+func (c *apiConfig) redeemAuthorizationCode(r *http.Request, client database.OAuthClient, refreshToken string) (database.Session, error) {
+	code := r.PostForm.Get("code")
+	record, err := c.db.GetAuthorizationCode(code)
+	if err != nil {
+		return database.Session{}, errInvalidGrant
+	}
+	if record.ClientId != client.ID || record.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return database.Session{}, errInvalidGrant
+	}
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), record.CodeChallenge) {
+		return database.Session{}, &oauthError{"invalid_grant", "Code verifier does not match the code challenge"}
+	}
+
+	session, err := c.db.RedeemAuthorizationCode(code, refreshToken, r.UserAgent(), clientIP(r))
+	if errors.Is(err, database.ErrCodeReused) {
+		log.Printf("SECURITY: authorization code reuse detected for client %s, revoked the tokens issued for it", client.ID)
+		c.recordEvent(r, audit.Event{
+			Action:  actionTokenRefresh,
+			Outcome: audit.OutcomeFailure,
+			Detail:  "authorization code reused by client " + client.ID + ", revoked the tokens issued for it",
+		})
+		return database.Session{}, errInvalidGrant
+	}
+	if errors.Is(err, database.ErrCodeInvalid) || errors.Is(err, database.ErrCodeExpired) {
+		return database.Session{}, errInvalidGrant
+	}
+	if err != nil {
+		return database.Session{}, err
+	}
+
+	return session, nil
+}
+
+// rotateClientRefreshToken exchanges the client's refresh token for
+// refreshToken. A client may ask for fewer scopes than it was granted, which
+// is checked before rotating so a refused request leaves its token usable.
+func (c *apiConfig) rotateClientRefreshToken(r *http.Request, client database.OAuthClient, refreshToken string, requested []string) (database.Session, error) {
+	if len(requested) > 0 {
+		current, err := c.db.LookupToken(r.PostForm.Get("refresh_token"))
+		if err == nil && current.ClientId == client.ID {
+			session, err := c.db.LookupSession(current.FamilyId)
+			if err == nil && !isSubset(requested, session.Scopes) {
+				return database.Session{}, &oauthError{"invalid_scope", "Requested scope exceeds the granted scope"}
+			}
+		}
+	}
+
+	token, err := c.db.RotateRefreshToken(r.PostForm.Get("refresh_token"), refreshToken, client.ID, r.UserAgent(), clientIP(r))
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("SECURITY: refresh token reuse detected for user %d, revoked token family %s", token.ID, token.FamilyId)
+		c.recordEvent(r, audit.Event{
+			ActorID: token.ID,
+			Action:  actionTokenRefresh,
+			Outcome: audit.OutcomeFailure,
+			Detail:  "refresh token of client " + client.ID + " reused, revoked session " + token.FamilyId,
+		})
+		return database.Session{}, errInvalidGrant
+	}
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) {
+		return database.Session{}, errInvalidGrant
+	}
+	if err != nil {
+		return database.Session{}, err
+	}
+
+	session, err := c.db.LookupSession(token.FamilyId)
+	if err != nil {
+		return database.Session{}, errInvalidGrant
+	}
+	if !isSubset(requested, session.Scopes) {
+		return database.Session{}, &oauthError{"invalid_scope", "Requested scope exceeds the granted scope"}
+	}
+
+	return session, nil
+}
+
+// revokeClientToken implements RFC 7009. Revoking either token of a client
+// ends the whole grant, and unknown tokens are not an error.
+func (c *apiConfig) revokeClientToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, &oauthError{"invalid_request", "Could not decode request"})
+		return
+	}
+
+	client, err := c.authenticateClient(r)
+	if err != nil {
+		respondWithOAuthError(w, http.StatusUnauthorized, errInvalidClient)
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		respondWithOAuthError(w, http.StatusBadRequest, &oauthError{"invalid_request", "Please provide a token"})
+		return
+	}
+
+	// unknown tokens are answered with 200, but a token that could not be
+	// revoked must not look revoked
+	claims, err := auth.ParseToken(token, c.keys)
+	if err == nil {
+		if claims.ClientID == client.ID {
+			err = c.db.RevokeClientSession(client.ID, claims.SessionID)
+		}
+	} else {
+		err = c.db.RevokeClientToken(client.ID, token)
+	}
+	if err != nil {
+		log.Printf("Failed to revoke token for client %s: %s", client.ID, err)
+		respondWithOAuthError(w, http.StatusServiceUnavailable, &oauthError{"temporarily_unavailable", "Failed to revoke token, please try again"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// introspectToken implements RFC 7662 for confidential clients, which may only
+// introspect tokens issued to themselves.
+func (c *apiConfig) introspectToken(w http.ResponseWriter, r *http.Request) {
+	type Res struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientID  string `json:"client_id,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		Exp       int64  `json:"exp,omitempty"`
+		Iat       int64  `json:"iat,omitempty"`
+		Sub       string `json:"sub,omitempty"`
+		Aud       string `json:"aud,omitempty"`
+		Iss       string `json:"iss,omitempty"`
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, http.StatusBadRequest, &oauthError{"invalid_request", "Could not decode request"})
+		return
+	}
+
+	client, err := c.authenticateClient(r)
+	if err != nil || !client.Confidential() {
+		respondWithOAuthError(w, http.StatusUnauthorized, errInvalidClient)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	token := r.PostForm.Get("token")
+
+	claims, err := auth.ParseToken(token, c.keys)
+	if err == nil {
+		_, sessionErr := c.db.LookupSession(claims.SessionID)
+		if claims.ClientID != client.ID || sessionErr != nil {
+			respondWithJSON(w, http.StatusOK, Res{Active: false})
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, Res{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			TokenType: "Bearer",
+			Exp:       claims.ExpiresAt.Unix(),
+			Iat:       claims.IssuedAt.Unix(),
+			Sub:       claims.Subject,
+			Aud:       auth.Audience,
+			Iss:       auth.Issuer,
+		})
+		return
+	}
+
+	record, err := c.db.LookupToken(token)
+	if err != nil || record.ClientId != client.ID || record.ReplacedBy != "" || database.CheckTokenExpiration(record) != nil {
+		respondWithJSON(w, http.StatusOK, Res{Active: false})
+		return
+	}
+	session, err := c.db.LookupSession(record.FamilyId)
+	if err != nil {
+		respondWithJSON(w, http.StatusOK, Res{Active: false})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{
+		Active:   true,
+		Scope:    strings.Join(session.Scopes, " "),
+		ClientID: client.ID,
+		Exp:      record.ExpiresAt.Unix(),
+		Sub:      strconv.Itoa(record.ID),
+		Iss:      auth.Issuer,
+	})
+}
+
+type oauthClientResponse struct {
+	ClientID     string    `json:"client_id"`
+	ClientSecret string    `json:"client_secret,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func presentOAuthClient(client database.OAuthClient) oauthClientResponse {
+	return oauthClientResponse{
+		ClientID:     client.ID,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		Confidential: client.Confidential(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// validRedirectURI accepts absolute https URIs, http only for loopback
+// addresses, and the private-use schemes of native apps (RFC 8252).
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Fragment != "" || u.Scheme == "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return strings.Contains(u.Scheme, ".")
+	}
+}
+
+// registerOAuthClient registers a third-party app owned by the caller. The
+// secret of confidential clients is only part of this response.
+func (c *apiConfig) registerOAuthClient(w http.ResponseWriter, r *http.Request) {
+	type Req struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		// Public clients, such as mobile and browser apps, cannot keep a
+		// secret and get none.
+		Public bool `json:"public"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > maxAPIKeyNameLength {
+		respondWithError(w, http.StatusBadRequest, "Name must be between 1 and 100 characters")
+		return
+	}
+	if len(req.RedirectURIs) == 0 || len(req.RedirectURIs) > maxRedirectURIs {
+		respondWithError(w, http.StatusBadRequest, "Please provide between 1 and 10 redirect URIs")
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		if !validRedirectURI(uri) {
+			respondWithError(w, http.StatusBadRequest, "Invalid redirect URI "+uri)
+			return
+		}
+	}
+	if len(req.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Please provide at least one scope")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			respondWithError(w, http.StatusBadRequest, "Unknown scope "+scope)
+			return
+		}
+	}
+
+	id, secret, err := auth.GenerateClientCredentials()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate client credentials")
+		return
+	}
+
+	client := database.OAuthClient{
+		ID:           id,
+		Name:         req.Name,
+		RedirectURIs: req.RedirectURIs,
+		Scopes:       req.Scopes,
+		OwnerId:      requestPrincipal(r).UserID,
+	}
+	if req.Public {
+		secret = ""
+	} else {
+		client.SecretHash = auth.HashClientSecret(secret)
+	}
+
+	client, err = c.db.CreateOAuthClient(client)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	c.recordEvent(r, audit.Event{Action: actionOAuthClientCreate, Outcome: audit.OutcomeSuccess, Detail: "client " + client.ID})
+
+	res := presentOAuthClient(client)
+	res.ClientSecret = secret
+	respondWithJSON(w, http.StatusCreated, res)
+}
+
+func (c *apiConfig) getOAuthClients(w http.ResponseWriter, r *http.Request) {
+	clients, err := c.db.ListOAuthClients(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := []oauthClientResponse{}
+	for _, v := range clients {
+		res = append(res, presentOAuthClient(v))
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+// deleteOAuthClient unregisters a client, revoking every grant users made to
+// it.
+func (c *apiConfig) deleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	err := c.db.DeleteOAuthClient(requestPrincipal(r).UserID, r.PathValue("id"))
+	if errors.Is(err, database.ErrClientNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to delete client")
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionOAuthClientDelete, Outcome: audit.OutcomeSuccess, Detail: "client " + r.PathValue("id")})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
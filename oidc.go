@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/database"
+	"github.com/abi-liu/chirpy/internal/oidc"
+)
+
+const (
+	// oidcLoginLifetime is how long a user has to finish signing in at the
+	// provider.
+	oidcLoginLifetime = 10 * time.Minute
+	oidcStateCookie   = "chirpy_oidc_state"
+)
+
+// loadOIDCProviders reads the providers named in OIDC_PROVIDERS, each
+// configured by OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID and
+// OIDC_<NAME>_CLIENT_SECRET.
+func loadOIDCProviders(publicURL string) map[string]*oidc.Provider {
+	providers := map[string]*oidc.Provider{}
+	for _, name := range splitList(os.Getenv("OIDC_PROVIDERS")) {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		cfg := oidc.Config{
+			Name:         name,
+			Issuer:       os.Getenv(prefix + "ISSUER"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			RedirectURL:  publicURL + "/api/oidc/" + name + "/callback",
+		}
+		if cfg.Issuer == "" || cfg.ClientID == "" {
+			log.Printf("Skipping OIDC provider %s, %sISSUER and %sCLIENT_ID are required", name, prefix, prefix)
+			continue
+		}
+		providers[name] = oidc.NewProvider(cfg)
+	}
+	return providers
+}
+
+// pendingOIDCLogin is a sign-in started at a provider and not finished yet.
+type pendingOIDCLogin struct {
+	provider     string
+	nonce        string
+	codeVerifier string
+	expiresAt    time.Time
+}
+
+// oidcLogins keeps pending sign-ins in memory, keyed by their state
+// parameter. A restart only makes users start over.
+type oidcLogins struct {
+	mu      sync.Mutex
+	pending map[string]pendingOIDCLogin
+}
+
+func newOIDCLogins() *oidcLogins {
+	return &oidcLogins{pending: map[string]pendingOIDCLogin{}}
+}
+
+func (l *oidcLogins) add(state string, login pendingOIDCLogin) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range l.pending {
+		if v.expiresAt.Before(now) {
+			delete(l.pending, k)
+		}
+	}
+	l.pending[state] = login
+}
+
+// take removes and returns the pending sign-in for state, so it can only be
+// completed once.
+func (l *oidcLogins) take(state string) (pendingOIDCLogin, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	login, ok := l.pending[state]
+	delete(l.pending, state)
+	if !ok || login.expiresAt.Before(time.Now()) {
+		return pendingOIDCLogin{}, false
+	}
+	return login, true
+}
+
+func randomString() (string, error) {
+	bytes := make([]byte, 32)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// startOIDCLogin sends the user to the provider to sign in. The state is also
+// set in a cookie, so the sign-in can only be completed by the browser that
+// started it.
+func (c *apiConfig) startOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := c.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	verifier, err := randomString()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to start login")
+		return
+	}
+	sum := sha256.Sum256([]byte(verifier))
+
+	redirect, err := provider.AuthCodeURL(r.Context(), state, nonce, base64.RawURLEncoding.EncodeToString(sum[:]))
+	if err != nil {
+		log.Printf("OIDC provider %s: %s", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Identity provider is unavailable")
+		return
+	}
+
+	c.oidcLogins.add(state, pendingOIDCLogin{
+		provider:     provider.Name,
+		nonce:        nonce,
+		codeVerifier: verifier,
+		expiresAt:    time.Now().Add(oidcLoginLifetime),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(c.publicURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+// finishOIDCLogin handles the user's return from the provider. The verified
+// identity logs in the user it is linked to, linking or creating one on the
+// first sign-in.
+func (c *apiConfig) finishOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	provider, ok := c.oidcProviders[r.PathValue("provider")]
+	if !ok {
+		respondWithError(w, http.StatusNotFound, "Unknown identity provider")
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1})
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		respondWithError(w, http.StatusBadRequest, "Login state does not match, please start over")
+		return
+	}
+	login, ok := c.oidcLogins.take(state)
+	if !ok || login.provider != provider.Name {
+		respondWithError(w, http.StatusBadRequest, "Login expired, please start over")
+		return
+	}
+
+	if query.Get("error") != "" {
+		respondWithError(w, http.StatusUnauthorized, "Identity provider declined the login: "+query.Get("error"))
+		return
+	}
+
+	rawIDToken, err := provider.Exchange(r.Context(), query.Get("code"), login.codeVerifier)
+	if err != nil {
+		log.Printf("OIDC provider %s: %s", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Failed to complete login with the identity provider")
+		return
+	}
+
+	idToken, err := provider.VerifyIDToken(r.Context(), rawIDToken, login.nonce)
+	if errors.Is(err, oidc.ErrDiscovery) {
+		log.Printf("OIDC provider %s: %s", provider.Name, err)
+		respondWithError(w, http.StatusBadGateway, "Identity provider is unavailable")
+		return
+	}
+	if err != nil {
+		log.Printf("SECURITY: rejected ID token from OIDC provider %s: %s", provider.Name, err)
+		c.recordLogin(r, 0, provider.Name+" login", err)
+		respondWithError(w, http.StatusUnauthorized, "Identity provider returned an invalid ID token")
+		return
+	}
+
+	if idToken.Email == "" || !idToken.EmailVerified {
+		respondWithError(w, http.StatusForbidden, "Identity provider did not share a verified email address")
+		return
+	}
+
+	user, created, err := c.db.SignInWithIdentity(database.Identity{
+		Provider: provider.Name,
+		Issuer:   provider.Issuer,
+		Subject:  idToken.Subject,
+		Email:    idToken.Email,
+	})
+	if errors.Is(err, database.ErrEmailNotVerified) {
+		c.recordLogin(r, 0, provider.Name+" login as "+idToken.Email, err)
+		respondWithError(w, http.StatusConflict, err.Error()+", log in with your password and verify it first")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if created {
+		log.Printf("Created user %d from OIDC provider %s", user.ID, provider.Name)
+	}
+	// a required password reset does not concern logins without a password
+	if errors.Is(accountStatus(user), errAccountSuspended) {
+		c.recordLogin(r, user.ID, provider.Name+" login", errAccountSuspended)
+		respondWithError(w, http.StatusForbidden, errAccountSuspended.Error())
+		return
+	}
+
+	if user.TOTPEnabled {
+		c.startMFAChallenge(w, user)
+		return
+	}
+
+	c.recordLogin(r, user.ID, provider.Name+" login", nil)
+	c.startSession(w, r, user, 0)
+}
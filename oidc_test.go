@@ -0,0 +1,378 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+	"github.com/abi-liu/chirpy/internal/oidc"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testPublicURL    = "http://chirpy.test"
+	testOIDCClientID = "chirpy"
+	testOIDCKid      = "fake-key"
+)
+
+// fakeOIDCProvider is an OpenID provider serving discovery, a JWKS, an
+// authorization endpoint that approves every request and a token endpoint
+// that checks PKCE before issuing the ID token built by claims.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+	// claims returns the claims of the ID token issued for a login that
+	// started with nonce.
+	claims func(nonce string) jwt.MapClaims
+	// signingKey signs ID tokens instead of key when set.
+	signingKey *ecdsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+}
+
+type fakeGrant struct {
+	nonce         string
+	codeChallenge string
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key, codes: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		respondWithJSON(w, http.StatusOK, oidc.Discovery{
+			Issuer:                p.URL,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+			SigningAlgs:           []string{"ES256"},
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		enc := base64.RawURLEncoding
+		respondWithJSON(w, http.StatusOK, auth.JWKSet{Keys: []auth.JWK{{
+			Kty: "EC",
+			Use: "sig",
+			Alg: "ES256",
+			Kid: testOIDCKid,
+			Crv: "P-256",
+			X:   enc.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			Y:   enc.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		code, err := randomString()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		p.mu.Lock()
+		p.codes[code] = fakeGrant{nonce: query.Get("nonce"), codeChallenge: query.Get("code_challenge")}
+		p.mu.Unlock()
+
+		redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+		http.Redirect(w, r, redirect, http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientId, _, _ := r.BasicAuth()
+		p.mu.Lock()
+		grant, ok := p.codes[r.FormValue("code")]
+		delete(p.codes, r.FormValue("code"))
+		p.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || clientId != testOIDCClientID || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.codeChallenge {
+			respondWithJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		signingKey := p.key
+		if p.signingKey != nil {
+			signingKey = p.signingKey
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, p.claims(grant.nonce))
+		token.Header["kid"] = testOIDCKid
+		idToken, err := token.SignedString(signingKey)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+// idTokenClaims returns the claims of a valid ID token for email.
+func (p *fakeOIDCProvider) idTokenClaims(nonce, email string) jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss":            p.URL,
+		"aud":            testOIDCClientID,
+		"sub":            "subject-" + email,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          nonce,
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+func newOIDCTestConfig(t *testing.T, provider *fakeOIDCProvider) (*apiConfig, http.Handler) {
+	t.Helper()
+
+	dir := t.TempDir()
+	db, err := database.CreateDB(filepath.Join(dir, "database.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &apiConfig{
+		db:         db,
+		keys:       auth.NewHMACKeyring("test-secret"),
+		throttle:   newLoginThrottle(),
+		views:      newViewCounter(),
+		publicURL:  testPublicURL,
+		audit:      audit.NewLog(filepath.Join(dir, "audit.log")),
+		oidcLogins: newOIDCLogins(),
+		oidcProviders: map[string]*oidc.Provider{
+			"fake": oidc.NewProvider(oidc.Config{
+				Name:         "fake",
+				Issuer:       provider.URL,
+				ClientID:     testOIDCClientID,
+				ClientSecret: "client-secret",
+				RedirectURL:  testPublicURL + "/api/oidc/fake/callback",
+			}),
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/oidc/{provider}/login", c.startOIDCLogin)
+	mux.HandleFunc("GET /api/oidc/{provider}/callback", c.finishOIDCLogin)
+	return c, mux
+}
+
+// runOIDCLogin signs in through the fake provider like a browser would and
+// returns the response to the callback.
+func runOIDCLogin(t *testing.T, handler http.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+
+	start := httptest.NewRecorder()
+	handler.ServeHTTP(start, httptest.NewRequest(http.MethodGet, testPublicURL+"/api/oidc/fake/login", nil))
+	if start.Code != http.StatusFound {
+		t.Fatalf("login status = %d, want %d: %s", start.Code, http.StatusFound, start.Body)
+	}
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err := noRedirects.Get(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize status = %d, want %d", res.StatusCode, http.StatusFound)
+	}
+
+	callback := httptest.NewRequest(http.MethodGet, res.Header.Get("Location"), nil)
+	for _, cookie := range start.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+	finish := httptest.NewRecorder()
+	handler.ServeHTTP(finish, callback)
+	return finish
+}
+
+func TestOIDCLogin(t *testing.T) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// setup prepares the database and provider before the login.
+		setup      func(t *testing.T, c *apiConfig, p *fakeOIDCProvider)
+		wantStatus int
+		// wantUser is the email of the user expected to be logged in.
+		wantUser string
+		// wantExisting is set when the login must reuse the user created in
+		// setup rather than create one.
+		wantExisting bool
+	}{
+		{
+			name: "creates a new user",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.claims = func(nonce string) jwt.MapClaims { return p.idTokenClaims(nonce, "new@example.com") }
+			},
+			wantStatus: http.StatusOK,
+			wantUser:   "new@example.com",
+		},
+		{
+			name: "links a verified existing user",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				user, err := c.db.CreateUser("verified@example.com", "hash")
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = c.db.MarkEmailVerified(user.ID, user.Email)
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.claims = func(nonce string) jwt.MapClaims { return p.idTokenClaims(nonce, "verified@example.com") }
+			},
+			wantStatus:   http.StatusOK,
+			wantUser:     "verified@example.com",
+			wantExisting: true,
+		},
+		{
+			name: "refuses an unverified existing user",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				_, err := c.db.CreateUser("unverified@example.com", "hash")
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.claims = func(nonce string) jwt.MapClaims { return p.idTokenClaims(nonce, "unverified@example.com") }
+			},
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name: "refuses an unverified email",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.claims = func(nonce string) jwt.MapClaims {
+					claims := p.idTokenClaims(nonce, "new@example.com")
+					claims["email_verified"] = false
+					return claims
+				}
+			},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name: "rejects a nonce mismatch",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.claims = func(nonce string) jwt.MapClaims { return p.idTokenClaims("other-nonce", "new@example.com") }
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "rejects a wrong audience",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.claims = func(nonce string) jwt.MapClaims {
+					claims := p.idTokenClaims(nonce, "new@example.com")
+					claims["aud"] = "other-client"
+					return claims
+				}
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "rejects a wrong azp",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.claims = func(nonce string) jwt.MapClaims {
+					claims := p.idTokenClaims(nonce, "new@example.com")
+					claims["aud"] = []string{testOIDCClientID, "other-client"}
+					claims["azp"] = "other-client"
+					return claims
+				}
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "rejects a bad signature",
+			setup: func(t *testing.T, c *apiConfig, p *fakeOIDCProvider) {
+				p.signingKey = otherKey
+				p.claims = func(nonce string) jwt.MapClaims { return p.idTokenClaims(nonce, "new@example.com") }
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := newFakeOIDCProvider(t)
+			c, handler := newOIDCTestConfig(t, provider)
+			tt.setup(t, c, provider)
+			existing, _ := c.db.GetUserByEmail(tt.wantUser)
+
+			res := runOIDCLogin(t, handler)
+			if res.Code != tt.wantStatus {
+				t.Fatalf("callback status = %d, want %d: %s", res.Code, tt.wantStatus, res.Body)
+			}
+			if tt.wantUser == "" {
+				return
+			}
+
+			body := struct {
+				ID    int    `json:"id"`
+				Email string `json:"email"`
+				Token string `json:"token"`
+			}{}
+			err := json.NewDecoder(res.Body).Decode(&body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body.Email != tt.wantUser || body.Token == "" {
+				t.Fatalf("logged in as %q with token %q, want %q", body.Email, body.Token, tt.wantUser)
+			}
+			if tt.wantExisting && body.ID != existing.ID {
+				t.Errorf("logged in as user %d, want existing user %d", body.ID, existing.ID)
+			}
+
+			user, err := c.db.FindUserById(body.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !user.EmailVerified {
+				t.Errorf("user %d email is not verified", user.ID)
+			}
+			claims, err := auth.ParseToken(body.Token, c.keys)
+			if err != nil || claims.Subject != strconv.Itoa(user.ID) {
+				t.Errorf("token subject = %v (%v), want %d", claims, err, user.ID)
+			}
+		})
+	}
+}
+
+func TestOIDCLoginRejectsForeignState(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	_, handler := newOIDCTestConfig(t, provider)
+	provider.claims = func(nonce string) jwt.MapClaims { return provider.idTokenClaims(nonce, "new@example.com") }
+
+	start := httptest.NewRecorder()
+	handler.ServeHTTP(start, httptest.NewRequest(http.MethodGet, testPublicURL+"/api/oidc/fake/login", nil))
+	location, err := url.Parse(start.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a callback without the state cookie, as from another browser
+	callback := httptest.NewRequest(http.MethodGet, testPublicURL+"/api/oidc/fake/callback?code=x&state="+url.QueryEscape(location.Query().Get("state")), nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, callback)
+	if res.Code != http.StatusBadRequest {
+		t.Fatalf("callback status = %d, want %d", res.Code, http.StatusBadRequest)
+	}
+}
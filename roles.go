@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+// bootstrapAdmin makes user the first admin when their verified email is
+// ADMIN_BOOTSTRAP_EMAIL and no admin exists yet. Once there is an admin,
+// roles can only be changed through the API.
+func (c *apiConfig) bootstrapAdmin(user database.User) database.User {
+	if c.adminBootstrapEmail == "" || !user.EmailVerified || !strings.EqualFold(user.Email, c.adminBootstrapEmail) {
+		return user
+	}
+
+	granted, err := c.db.BootstrapRole(user.ID, auth.RoleAdmin)
+	if err != nil {
+		log.Printf("Failed to bootstrap admin: %s", err)
+		return user
+	}
+	if granted {
+		log.Printf("SECURITY: bootstrapped user %d as the first admin", user.ID)
+		user.Role = auth.RoleAdmin
+	}
+
+	return user
+}
+
+func (c *apiConfig) setUserRole(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Please enter a valid user id")
+		return
+	}
+
+	type Req struct {
+		Role string `json:"role"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err = decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	if !auth.ValidRole(req.Role) {
+		respondWithError(w, http.StatusBadRequest, "Role must be one of user, moderator or admin")
+		return
+	}
+
+	// keeps the last admin from locking everyone out by demoting themselves
+	actorId := requestPrincipal(r).UserID
+	if userId == actorId {
+		respondWithError(w, http.StatusForbidden, "You cannot change your own role")
+		return
+	}
+
+	user, err := c.db.FindUserById(userId)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	role := req.Role
+	if role == auth.RoleUser {
+		role = ""
+	}
+	err = c.db.SetRole(userId, role)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.recordAdminAction(r, actionAdminRole, userId, userRole(user)+" to "+req.Role)
+
+	type Res struct {
+		ID    int    `json:"id"`
+		Email string `json:"email"`
+		Role  string `json:"role"`
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{
+		ID:    userId,
+		Email: user.Email,
+		Role:  req.Role,
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+func (c *apiConfig) getSessions(w http.ResponseWriter, r *http.Request) {
+	principal := requestPrincipal(r)
+
+	type session struct {
+		ID         string    `json:"id"`
+		CreatedAt  time.Time `json:"created_at"`
+		LastUsedAt time.Time `json:"last_used_at"`
+		UserAgent  string    `json:"user_agent"`
+		IP         string    `json:"ip"`
+		ClientId   string    `json:"client_id,omitempty"`
+		Current    bool      `json:"current"`
+	}
+
+	sessions, err := c.db.ListSessions(principal.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	res := []session{}
+	for _, v := range sessions {
+		res = append(res, session{
+			ID:         v.ID,
+			CreatedAt:  v.CreatedAt,
+			LastUsedAt: v.LastUsedAt,
+			UserAgent:  v.UserAgent,
+			IP:         v.IP,
+			ClientId:   v.ClientId,
+			Current:    v.ID == principal.SessionID,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, res)
+}
+
+func (c *apiConfig) revokeSession(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	err := c.db.RevokeSession(userId, r.PathValue("id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke session")
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionSessionRevoke, Outcome: audit.OutcomeSuccess, Detail: "session " + r.PathValue("id")})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// revokeAllSessions logs the user out everywhere, including the session of
+// the request itself.
+func (c *apiConfig) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	_, err := c.db.RevokeAllSessions(userId, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
+	}
+	c.recordEvent(r, audit.Event{Action: actionSessionRevokeAll, Outcome: audit.OutcomeSuccess})
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// clientIP returns the address of the peer that sent r.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
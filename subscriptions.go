@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+type subscriptionResponse struct {
+	Plan        string     `json:"plan,omitempty"`
+	Status      string     `json:"status"`
+	IsChirpyRed bool       `json:"is_chirpy_red"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	RenewedAt   *time.Time `json:"renewed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CanceledAt  *time.Time `json:"canceled_at,omitempty"`
+	GraceEndsAt *time.Time `json:"grace_ends_at,omitempty"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+}
+
+// presentSubscription describes the user's subscription, with status "none"
+// when they never had one.
+func presentSubscription(user database.User) subscriptionResponse {
+	sub, ok := user.CurrentSubscription()
+	if !ok {
+		return subscriptionResponse{Status: "none"}
+	}
+
+	res := subscriptionResponse{
+		Plan:        sub.Plan,
+		Status:      sub.Status,
+		IsChirpyRed: user.IsChirpyRed,
+		RenewedAt:   sub.RenewedAt,
+		ExpiresAt:   sub.ExpiresAt,
+		CanceledAt:  sub.CanceledAt,
+		GraceEndsAt: sub.GraceEndsAt,
+		EndedAt:     sub.EndedAt,
+	}
+	if !sub.StartedAt.IsZero() {
+		res.StartedAt = &sub.StartedAt
+	}
+	return res
+}
+
+func (c *apiConfig) getSubscription(w http.ResponseWriter, r *http.Request) {
+	user, err := c.db.FindUserById(requestPrincipal(r).UserID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, presentSubscription(user))
+}
+
+// expireSubscriptions moves subscriptions past their end into their grace
+// period, and out of Chirpy Red once that is over, every interval. It runs
+// until the process exits.
+func (c *apiConfig) expireSubscriptions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changed, err := c.db.ExpireSubscriptions(time.Now().UTC(), c.subscriptionGrace)
+		if err != nil {
+			log.Printf("Failed to expire subscriptions: %s", err)
+			continue
+		}
+
+		expired := 0
+		for _, user := range changed {
+			action, detail := actionChirpyRedPastDue, "not renewed"
+			if user.Subscription.Status == database.SubscriptionExpired {
+				action = actionChirpyRedExpire
+				expired++
+			}
+			if user.Subscription.CanceledAt != nil {
+				detail = "canceled"
+			}
+			c.recordEvent(nil, audit.Event{Action: action, TargetID: user.ID, Outcome: audit.OutcomeSuccess, Detail: detail})
+		}
+		if len(changed) > 0 {
+			log.Printf("Expired %d subscriptions, %d more in their grace period", expired, len(changed)-expired)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+// Failed logins are tracked per account and per client IP. Once a key reaches
+// its threshold every further failure locks it for twice as long as the last,
+// starting at baseLockout and capped at maxLockout. Keys without a failure
+// for failureWindow start over. At most maxTrackedKeys keys are tracked, the
+// ones with the oldest failures are forgotten first.
+const (
+	accountFailureThreshold = 5
+	ipFailureThreshold      = 20
+	baseLockout             = 30 * time.Second
+	maxLockout              = time.Hour
+	failureWindow           = 24 * time.Hour
+	maxTrackedKeys          = 10000
+)
+
+type loginThrottle struct {
+	mu       sync.Mutex
+	attempts map[string]*failedAttempts
+}
+
+type failedAttempts struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func newLoginThrottle() *loginThrottle {
+	return &loginThrottle{attempts: map[string]*failedAttempts{}}
+}
+
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// lockedFor returns how long the longest lockout among keys still lasts.
+func (t *loginThrottle) lockedFor(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	wait := time.Duration(0)
+	now := time.Now()
+	for _, key := range keys {
+		if a, ok := t.attempts[key]; ok && a.LockedUntil.After(now) {
+			wait = max(wait, a.LockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+func (t *loginThrottle) recordFailure(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if len(t.attempts) >= maxTrackedKeys {
+		t.prune(now)
+	}
+
+	for _, key := range keys {
+		a, ok := t.attempts[key]
+		if !ok || now.Sub(a.LastFailure) > failureWindow {
+			a = &failedAttempts{}
+			t.attempts[key] = a
+		}
+		a.Failures++
+		a.LastFailure = now
+
+		threshold := accountFailureThreshold
+		if strings.HasPrefix(key, "ip:") {
+			threshold = ipFailureThreshold
+		}
+		if a.Failures >= threshold {
+			backoff := float64(baseLockout) * math.Pow(2, float64(a.Failures-threshold))
+			a.LockedUntil = now.Add(time.Duration(min(backoff, float64(maxLockout))))
+		}
+	}
+}
+
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.attempts, key)
+}
+
+// prune forgets keys whose failures are too old to matter. When that leaves
+// too many keys, as when failures are sprayed over many accounts and IPs, the
+// keys with the oldest failures are forgotten down to a tenth below
+// maxTrackedKeys, so the next failures do not each have to evict again. The
+// caller must hold mu.
+func (t *loginThrottle) prune(now time.Time) {
+	for key, a := range t.attempts {
+		if now.Sub(a.LastFailure) > failureWindow && a.LockedUntil.Before(now) {
+			delete(t.attempts, key)
+		}
+	}
+	if len(t.attempts) < maxTrackedKeys {
+		return
+	}
+
+	keys := make([]string, 0, len(t.attempts))
+	for key := range t.attempts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		return t.attempts[keys[a]].LastFailure.Before(t.attempts[keys[b]].LastFailure)
+	})
+	for _, key := range keys[:len(keys)-maxTrackedKeys*9/10] {
+		delete(t.attempts, key)
+	}
+}
+
+// pruneLoginThrottle prunes the login throttle every interval. It runs until
+// the process exits.
+func (c *apiConfig) pruneLoginThrottle(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.throttle.mu.Lock()
+		c.throttle.prune(time.Now())
+		c.throttle.mu.Unlock()
+	}
+}
+
+type lockout struct {
+	Key string `json:"key"`
+	failedAttempts
+}
+
+// lockouts lists the keys that are currently locked out.
+func (t *loginThrottle) lockouts() []lockout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	list := []lockout{}
+	now := time.Now()
+	for key, a := range t.attempts {
+		if a.LockedUntil.After(now) {
+			list = append(list, lockout{Key: key, failedAttempts: *a})
+		}
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].LockedUntil.After(list[b].LockedUntil)
+	})
+	return list
+}
+
+var errLockedOut = errors.New("Too many failed login attempts, try again later")
+
+func respondLockedOut(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, errLockedOut.Error())
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// compareDummyPassword spends as long as a real password check, so unknown
+// emails cannot be told apart from wrong passwords by timing.
+func compareDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = database.HashPassword("chirpy-dummy-password")
+	})
+	database.ComparePassword(password, dummyHash)
+}
+
+func (c *apiConfig) getLockouts(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, c.throttle.lockouts())
+}
+
+// clearLockout lifts the lockout of an account, given by the email query
+// parameter, or of a client, given by ip.
+func (c *apiConfig) clearLockout(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Query().Get("email") != "":
+		c.throttle.reset(accountKey(r.URL.Query().Get("email")))
+	case r.URL.Query().Get("ip") != "":
+		c.throttle.reset("ip:" + r.URL.Query().Get("ip"))
+	default:
+		respondWithError(w, http.StatusBadRequest, "Please provide an email or ip")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
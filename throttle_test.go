@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLoginThrottleIsBounded(t *testing.T) {
+	throttle := newLoginThrottle()
+
+	// a spray of fresh failures, none of them old enough to be pruned
+	for i := 0; i < 2*maxTrackedKeys; i++ {
+		throttle.recordFailure(fmt.Sprintf("ip:10.0.%d.%d", i/256, i%256))
+	}
+	if len(throttle.attempts) > maxTrackedKeys {
+		t.Fatalf("tracked %d keys, want at most %d", len(throttle.attempts), maxTrackedKeys)
+	}
+
+	// the oldest failures are forgotten first
+	if _, ok := throttle.attempts["ip:10.0.0.0"]; ok {
+		t.Error("the oldest key was kept")
+	}
+	newest := fmt.Sprintf("ip:10.0.%d.%d", (2*maxTrackedKeys-1)/256, (2*maxTrackedKeys-1)%256)
+	if _, ok := throttle.attempts[newest]; !ok {
+		t.Error("the newest key was evicted")
+	}
+}
+
+func TestLoginThrottlePrunesStaleKeys(t *testing.T) {
+	throttle := newLoginThrottle()
+	throttle.recordFailure("account:stale@example.com")
+	throttle.recordFailure("account:fresh@example.com")
+	throttle.attempts["account:stale@example.com"].LastFailure = time.Now().Add(-failureWindow - time.Minute)
+
+	throttle.mu.Lock()
+	throttle.prune(time.Now())
+	throttle.mu.Unlock()
+
+	if _, ok := throttle.attempts["account:stale@example.com"]; ok {
+		t.Error("a stale key was kept")
+	}
+	if _, ok := throttle.attempts["account:fresh@example.com"]; !ok {
+		t.Error("a fresh key was pruned")
+	}
+}
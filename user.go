@@ -2,11 +2,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
 
+	"github.com/abi-liu/chirpy/internal/audit"
 	"github.com/abi-liu/chirpy/internal/auth"
 	"github.com/abi-liu/chirpy/internal/database"
 )
@@ -34,6 +35,9 @@ func (c *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 	if !ok {
 		return
 	}
+	if ok := c.validateNewPassword(w, req.Password, req.Email); !ok {
+		return
+	}
 
 	_, err = c.db.GetUserByEmail(req.Email)
 	if err == nil {
@@ -50,6 +54,12 @@ func (c *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 	user, err := c.db.CreateUser(req.Email, hashedPassword)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = c.sendVerificationEmail(user)
+	if err != nil {
+		log.Printf("Failed to send verification email: %s", err)
 	}
 
 	respondWithJSON(w, http.StatusCreated, Res{
@@ -65,13 +75,6 @@ func (c *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		Password         string `json:"password"`
 		ExpiresInSeconds int    `json:"expires_in_seconds"`
 	}
-	type Res struct {
-		ID           int    `json:"id"`
-		Email        string `json:"email"`
-		Token        string `json:"token"`
-		RefreshToken string `json:"refresh_token"`
-		IsChirpyRed  bool   `json:"is_chirpy_red"`
-	}
 
 	decoder := json.NewDecoder(r.Body)
 	req := &Req{}
@@ -88,154 +91,334 @@ func (c *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := c.db.GetUserByEmail(req.Email)
+	user, wait, err := c.checkPassword(r, req.Email, req.Password)
+	if wait > 0 {
+		c.recordLogin(r, 0, "password login as "+req.Email, errLockedOut)
+		respondLockedOut(w, wait)
+		return
+	}
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "User does not exist")
+		c.recordLogin(r, user.ID, "password login as "+req.Email, err)
+		respondWithError(w, accountStatusCode(err), err.Error())
 		return
 	}
 
-	err = database.ComparePassword(req.Password, user.Password)
+	if user.TOTPEnabled {
+		c.startMFAChallenge(w, user)
+		return
+	}
 
+	c.throttle.reset(accountKey(user.Email))
+	c.recordLogin(r, user.ID, "password", nil)
+	c.startSession(w, r, user, req.ExpiresInSeconds)
+}
+
+// recordLogin adds a login attempt to the audit log. Attempts refused for
+// the state of the account rather than wrong credentials count as denied.
+// Failed attempts were not made by the user, who is only their target.
+func (c *apiConfig) recordLogin(r *http.Request, userId int, detail string, err error) {
+	event := audit.Event{ActorID: userId, Action: actionLogin, Outcome: outcome(err), Detail: detail}
+	if errors.Is(err, errAccountSuspended) || errors.Is(err, errPasswordResetRequired) || errors.Is(err, errLockedOut) {
+		event.Outcome = audit.OutcomeDenied
+	}
+	if event.Outcome == audit.OutcomeFailure {
+		event.ActorID, event.TargetID = 0, userId
+	}
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Passwords do not match")
-		return
+		event.Detail += ": " + err.Error()
+	}
+	c.recordEvent(r, event)
+}
+
+// startMFAChallenge answers a login of a user with two-factor authentication
+// enabled. The first factor only earns a challenge token, exchanged for real
+// tokens at POST /api/login/mfa.
+func (c *apiConfig) startMFAChallenge(w http.ResponseWriter, user database.User) {
+	type Res struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
 	}
 
-	token, err := auth.GenerateToken(c.jwt, user.ID, req.ExpiresInSeconds)
+	mfaToken, err := auth.GenerateMFAToken(c.keys, user.ID)
 	if err != nil {
-		log.Printf("failed to generate JWT: %v", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to generate JWT")
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate MFA token")
 		return
 	}
 
+	respondWithJSON(w, http.StatusOK, Res{MFARequired: true, MFAToken: mfaToken})
+}
+
+var (
+	errInvalidCredentials    = errors.New("Incorrect email or password")
+	errAccountSuspended      = errors.New("Account is suspended")
+	errPasswordResetRequired = errors.New("Password must be reset, check your email for a reset link")
+)
+
+// checkPassword verifies an email and password, counting failures towards the
+// login throttle. A positive duration means the account or the client is
+// locked out and the password was not checked.
+func (c *apiConfig) checkPassword(r *http.Request, email, password string) (database.User, time.Duration, error) {
+	account, ip := accountKey(email), ipKey(r)
+	if wait := c.throttle.lockedFor(account, ip); wait > 0 {
+		return database.User{}, wait, nil
+	}
+
+	// unknown emails and wrong passwords get the same answer after the same
+	// amount of work, so neither reveals whether an account exists
+	user, err := c.db.GetUserByEmail(email)
+	if err != nil {
+		compareDummyPassword(password)
+		c.throttle.recordFailure(account, ip)
+		return database.User{}, 0, errInvalidCredentials
+	}
+
+	// the user is still returned so the attempt can be attributed to them
+	err = database.ComparePassword(password, user.Password)
+	if err != nil {
+		c.throttle.recordFailure(account, ip)
+		return user, 0, errInvalidCredentials
+	}
+	c.rehashPassword(user, password)
+
+	// only told to callers who know the password, along with the user
+	err = accountStatus(user)
+	if err != nil {
+		return user, 0, err
+	}
+
+	return user, 0, nil
+}
+
+// accountStatus reports whether user may log in, returning
+// errAccountSuspended or errPasswordResetRequired otherwise.
+func accountStatus(user database.User) error {
+	if user.SuspendedAt != nil {
+		return errAccountSuspended
+	}
+	if user.PasswordResetRequired {
+		return errPasswordResetRequired
+	}
+	return nil
+}
+
+// accountStatusCode is the status code to answer an accountStatus error with.
+func accountStatusCode(err error) int {
+	if errors.Is(err, errAccountSuspended) || errors.Is(err, errPasswordResetRequired) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// startSession logs user in, issuing an access token and the refresh token
+// of a new session.
+func (c *apiConfig) startSession(w http.ResponseWriter, r *http.Request, user database.User, expiresInSeconds int) {
+	type Res struct {
+		ID           int    `json:"id"`
+		Email        string `json:"email"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+		IsChirpyRed  bool   `json:"is_chirpy_red"`
+		Role         string `json:"role"`
+	}
+
+	user = c.bootstrapAdmin(user)
+
 	refreshToken, err := auth.GenerateRefreshToken()
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to generate refresh token")
 		return
 	}
 
-	err = c.db.UpdateRefreshToken(user.ID, refreshToken)
+	session, err := c.db.CreateSession(user.ID, refreshToken, r.UserAgent(), clientIP(r))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "Failed to save refresh token to db")
 		return
 	}
 
+	token, err := auth.GenerateToken(c.keys, user.ID, expiresInSeconds, session.ID, userRole(user))
+	if err != nil {
+		log.Printf("failed to generate JWT: %v", err)
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate JWT")
+		return
+	}
+
 	respondWithJSON(w, http.StatusOK, Res{
 		ID:           user.ID,
 		Email:        user.Email,
 		Token:        token,
 		RefreshToken: refreshToken,
 		IsChirpyRed:  user.IsChirpyRed,
+		Role:         userRole(user),
 	})
 }
 
-func (c *apiConfig) updateUserCredentials(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Authorization")
-	log.Print(token)
-	arr := strings.Split(token, "Bearer ")
-	if len(arr) < 2 {
-		respondWithError(w, http.StatusUnauthorized, "Token not present")
-		return
+// changePassword sets a new password for the caller, who has to confirm the
+// current one.
+func (c *apiConfig) changePassword(w http.ResponseWriter, r *http.Request) {
+	principal := requestPrincipal(r)
+
+	type Req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
 	}
-	token = arr[1]
-	id, err := auth.ParseToken(token, c.jwt)
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
 		return
 	}
 
-	log.Print(id)
-
-	intId, err := strconv.Atoi(id)
+	user, err := c.db.FindUserById(principal.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to convert id to int")
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if ok := c.reauthenticate(w, r, user, req.CurrentPassword); !ok {
+		return
+	}
+	if ok := c.validateNewPassword(w, req.NewPassword, user.Email); !ok {
 		return
 	}
 
+	hashedPassword, err := database.HashPassword(req.NewPassword)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
+		respondWithError(w, http.StatusInternalServerError, "Failed to hash password")
 		return
 	}
 
-	type Req struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+	err = c.db.SetPassword(user.ID, hashedPassword)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	type Res struct {
-		ID          int    `json:"id"`
-		Email       string `json:"email"`
-		IsChirpyRed bool   `json:"is_chirpy_red"`
-	}
+	c.recordEvent(r, audit.Event{Action: actionPasswordChange, Outcome: audit.OutcomeSuccess})
 
-	decoder := json.NewDecoder(r.Body)
-	req := &Req{}
-	err = decoder.Decode(req)
+	// a new password logs out every other device
+	_, err = c.db.RevokeAllSessions(user.ID, principal.SessionID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Could not decode request")
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke sessions")
+		return
 	}
 
-	if ok := validateRequestCredentials(w, req.Email, req.Password); !ok {
-		return
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// reauthenticate checks the password of a user who is already logged in,
+// before a sensitive change to their account.
+func (c *apiConfig) reauthenticate(w http.ResponseWriter, r *http.Request, user database.User, password string) bool {
+	if user.Password == "" {
+		respondWithError(w, http.StatusForbidden, "Set a password with a password reset first")
+		return false
 	}
 
-	user, err := c.db.UpdateCredentials(intId, req.Email, req.Password)
+	_, wait, err := c.checkPassword(r, user.Email, password)
+	if wait > 0 {
+		respondLockedOut(w, wait)
+		return false
+	}
+	// the password is right, and changing it is how a required reset is done
+	if errors.Is(err, errPasswordResetRequired) {
+		return true
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+		respondWithError(w, http.StatusUnauthorized, "Incorrect password")
+		return false
 	}
 
-	respondWithJSON(w, http.StatusOK, Res{
-		ID:          user.ID,
-		Email:       user.Email,
-		IsChirpyRed: user.IsChirpyRed,
-	})
+	return true
 }
 
 func (c *apiConfig) refreshToken(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	arr := strings.Split(authHeader, "Bearer ")
-	if len(arr) < 2 {
-		respondWithError(w, http.StatusUnauthorized, "Token not provided")
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		respondWithAuthError(w, err)
 		return
 	}
-	tokenStr := arr[1]
 
-	token, err := c.db.LookupToken(tokenStr)
+	newRefreshToken, err := auth.GenerateRefreshToken()
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to generate refresh token")
+		return
+	}
+
+	token, err := c.db.RotateRefreshToken(tokenStr, newRefreshToken, "", r.UserAgent(), clientIP(r))
+	if errors.Is(err, database.ErrTokenReused) {
+		log.Printf("SECURITY: refresh token reuse detected for user %d, revoked token family %s", token.ID, token.FamilyId)
+		c.recordEvent(r, audit.Event{
+			ActorID: token.ID,
+			Action:  actionTokenRefresh,
+			Outcome: audit.OutcomeFailure,
+			Detail:  "refresh token reused, revoked session " + token.FamilyId,
+		})
+		respondWithError(w, http.StatusUnauthorized, "Token has been revoked")
+		return
+	}
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) {
+		c.recordEvent(r, audit.Event{Action: actionTokenRefresh, Outcome: audit.OutcomeFailure, Detail: err.Error()})
+	}
+	if errors.Is(err, database.ErrTokenNotFound) {
 		respondWithError(w, http.StatusUnauthorized, "Token does not exist")
 		return
 	}
+	if errors.Is(err, database.ErrTokenExpired) {
+		respondWithError(w, http.StatusUnauthorized, "Token expired")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to rotate refresh token")
+		return
+	}
 
-	err = database.CheckTokenExpiration(token)
+	user, err := c.db.FindUserById(token.ID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Token expired")
+		respondWithError(w, http.StatusUnauthorized, "User does not exist")
 		return
 	}
 
-	jwt, err := auth.GenerateToken(c.jwt, token.ID, 60*60)
+	jwt, err := auth.GenerateToken(c.keys, token.ID, 60*60, token.FamilyId, userRole(user))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "failed to generate access token")
 		return
 	}
+	c.recordEvent(r, audit.Event{
+		ActorID: token.ID,
+		Action:  actionTokenRefresh,
+		Outcome: audit.OutcomeSuccess,
+		Detail:  "session " + token.FamilyId,
+	})
 
 	type Res struct {
-		Token string `json:"token"`
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
 	}
 
-	respondWithJSON(w, http.StatusOK, Res{Token: jwt})
+	respondWithJSON(w, http.StatusOK, Res{Token: jwt, RefreshToken: token.Token})
 }
 
 func (c *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	arr := strings.Split(authHeader, "Bearer ")
-	if len(arr) < 2 {
-		respondWithError(w, http.StatusUnauthorized, "Token not provided")
+	tokenStr, err := bearerToken(r)
+	if err != nil {
+		respondWithAuthError(w, err)
 		return
 	}
-	tokenStr := arr[1]
 
-	c.db.DeleteToken(tokenStr)
+	token, err := c.db.LookupToken(tokenStr)
+	if err == nil {
+		c.recordEvent(r, audit.Event{
+			ActorID: token.ID,
+			Action:  actionTokenRevoke,
+			Outcome: audit.OutcomeSuccess,
+			Detail:  "session " + token.FamilyId,
+		})
+	}
+	err = c.db.DeleteToken(tokenStr)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to revoke token")
+		return
+	}
 
 	respondWithJSON(w, http.StatusNoContent, "")
 }
@@ -247,3 +430,64 @@ func validateRequestCredentials(w http.ResponseWriter, email, password string) b
 	}
 	return true
 }
+
+// validateNewPassword checks a password being set for the owner of email
+// against the password policy.
+func (c *apiConfig) validateNewPassword(w http.ResponseWriter, password, email string) bool {
+	err := c.passwordPolicy.Validate(password, email)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// rehashPassword upgrades the stored hash of user after a successful login
+// when it was made with an older algorithm or cost. Failures only mean the
+// upgrade is retried next time. Passwords that must be reset are left alone,
+// as storing them would count as the reset.
+func (c *apiConfig) rehashPassword(user database.User, password string) {
+	if user.PasswordResetRequired || !database.NeedsRehash(user.Password) {
+		return
+	}
+
+	hashedPassword, err := database.HashPassword(password)
+	if err == nil {
+		err = c.db.SetPassword(user.ID, hashedPassword)
+	}
+	if err != nil {
+		log.Printf("Failed to rehash password of user %d: %s", user.ID, err)
+	}
+}
+
+func (c *apiConfig) updatePreferences(w http.ResponseWriter, r *http.Request) {
+	userId := requestPrincipal(r).UserID
+
+	type Req struct {
+		SensitiveMedia string `json:"sensitive_media"`
+	}
+	type Res struct {
+		SensitiveMedia string `json:"sensitive_media"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	req := Req{}
+	err := decoder.Decode(&req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Could not decode request")
+		return
+	}
+
+	if req.SensitiveMedia != database.SensitiveMediaExpand && req.SensitiveMedia != database.SensitiveMediaHide {
+		respondWithError(w, http.StatusBadRequest, "sensitive_media must be either expand or hide")
+		return
+	}
+
+	user, err := c.db.SetSensitiveMediaPreference(userId, req.SensitiveMedia)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, Res{SensitiveMedia: user.SensitiveMedia})
+}
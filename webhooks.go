@@ -1,72 +1,326 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abi-liu/chirpy/internal/audit"
+	"github.com/abi-liu/chirpy/internal/auth"
+	"github.com/abi-liu/chirpy/internal/database"
+)
+
+const (
+	// maxWebhookBodySize bounds the body read to verify a webhook signature.
+	maxWebhookBodySize        = 1 << 20
+	defaultWebhookEventsLimit = 50
+	maxWebhookEventsLimit     = 500
 )
 
+// replayCache remembers accepted webhook deliveries for as long as their
+// timestamp is accepted, so a captured delivery cannot be sent again.
+type replayCache struct {
+	mu         sync.Mutex
+	deliveries map[string]time.Time
+}
+
+func newReplayCache() *replayCache {
+	return &replayCache{deliveries: map[string]time.Time{}}
+}
+
+// seen reports whether delivery was already accepted.
+func (c *replayCache) seen(delivery string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt, ok := c.deliveries[delivery]
+	return ok && !expiresAt.Before(time.Now())
+}
+
+// add records delivery as accepted until expiresAt.
+func (c *replayCache) add(delivery string, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.deliveries {
+		if v.Before(now) {
+			delete(c.deliveries, k)
+		}
+	}
+	c.deliveries[delivery] = expiresAt
+}
+
+// receiveWebhook handles Polka payment events. Deliveries must be signed with
+// a Polka secret over their timestamp and raw body, and recent, so neither
+// forged nor replayed events are acted upon. Accepted events are stored in
+// the inbox and processed by processWebhookEvents, each event id only once.
 func (c *apiConfig) receiveWebhook(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	arr := strings.Split(authHeader, "ApiKey ")
-	if len(arr) < 2 {
-		log.Print("missing key")
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		respondWithError(w, http.StatusRequestEntityTooLarge, "Request body is too large")
+		return
+	}
+
+	err = auth.VerifyWebhook(c.polkaSecrets, r.Header.Get(auth.WebhookTimestampHeader), r.Header.Get(auth.WebhookSignatureHeader), body, time.Now(), c.polkaReplayWindow)
+	if err != nil {
+		log.Printf("SECURITY: rejected Polka webhook from %s: %s", clientIP(r), err)
+		c.recordEvent(r, audit.Event{Action: actionWebhookRejected, Outcome: audit.OutcomeDenied, Detail: err.Error()})
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
-	token := arr[1]
-	if token != c.polka {
-		log.Printf("Not equal - token %s\n received %s", c.polka, token)
+	// the delivery itself identifies a replay, however its headers are written
+	timestamp, _ := strconv.ParseInt(r.Header.Get(auth.WebhookTimestampHeader), 10, 64)
+	sum := sha256.Sum256(body)
+	delivery := strconv.FormatInt(timestamp, 10) + "." + hex.EncodeToString(sum[:])
+	if c.webhookReplays.seen(delivery) {
+		log.Printf("SECURITY: rejected replayed Polka webhook from %s", clientIP(r))
+		c.recordEvent(r, audit.Event{Action: actionWebhookRejected, Outcome: audit.OutcomeDenied, Detail: "webhook was already received"})
 		respondWithError(w, http.StatusUnauthorized, "Unauthorized")
 		return
 	}
 
-	type Req struct {
-		Event string `json:"event"`
-		Data  struct {
-			UserId int `json:"user_id"`
-		} `json:"data"`
+	req := polkaEvent{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Failed to decode params")
+		return
+	}
+
+	// events without an id are told apart by their content
+	id := req.ID
+	if id == "" {
+		id = "sha256-" + hex.EncodeToString(sum[:])
+	}
+
+	event, created, err := c.db.ReceiveWebhookEvent(database.WebhookEvent{
+		ID:       "polka:" + id,
+		Provider: "polka",
+		Event:    req.Event,
+		Payload:  body,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "Failed to store webhook event")
+		return
+	}
+	// only a stored delivery counts as received, so Polka can retry one that
+	// failed here, and a copy racing this one is deduplicated by event id
+	c.webhookReplays.add(delivery, time.Now().Add(2*c.polkaReplayWindow))
+	if !created {
+		log.Printf("Ignoring redelivered webhook event %s", event.ID)
+	} else {
+		c.wakeWebhookWorker()
+	}
+
+	respondWithJSON(w, http.StatusNoContent, struct{}{})
+}
+
+// polkaEvent is the payload of a Polka webhook.
+type polkaEvent struct {
+	ID    string `json:"id"`
+	Event string `json:"event"`
+	Data  struct {
+		UserId int    `json:"user_id"`
+		Plan   string `json:"plan"`
+		// CurrentPeriodEnd is when the period paid for ends, if Polka says.
+		CurrentPeriodEnd *time.Time `json:"current_period_end"`
+	} `json:"data"`
+}
+
+// polkaSubscriptionActions are the Polka events about Chirpy Red
+// subscriptions, with the audit action each is recorded as.
+var polkaSubscriptionActions = map[string]string{
+	"user.upgraded":       actionChirpyRedUpgrade,
+	"user.renewed":        actionChirpyRedRenew,
+	"user.downgraded":     actionChirpyRedCancel,
+	"user.payment_failed": actionChirpyRedPastDue,
+	"user.refunded":       actionChirpyRedRefund,
+}
+
+// errWebhookPermanent marks processing errors that retrying cannot fix.
+var errWebhookPermanent = errors.New("permanent failure")
+
+// processWebhookEvents works through the inbox every interval, or as soon as
+// an event is received. It runs until the process exits.
+func (c *apiConfig) processWebhookEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.webhookWake:
+		}
+
+		events, err := c.db.DueWebhookEvents(time.Now().UTC())
+		if err != nil {
+			log.Printf("Failed to read webhook inbox: %s", err)
+			continue
+		}
+		for _, event := range events {
+			c.processWebhookEvent(event)
+		}
+	}
+}
+
+func (c *apiConfig) wakeWebhookWorker() {
+	select {
+	case c.webhookWake <- struct{}{}:
+	default:
 	}
+}
 
-	type Res struct{}
+// processWebhookEvent makes one attempt at an event. Failed attempts are
+// retried with exponential backoff until webhookMaxAttempts is reached.
+func (c *apiConfig) processWebhookEvent(event database.WebhookEvent) {
+	procErr := c.applyPolkaEvent(event)
 
-	decoder := json.NewDecoder(r.Body)
-	req := Req{}
-	err := decoder.Decode(&req)
+	var retryAt *time.Time
+	if procErr != nil && !errors.Is(procErr, errWebhookPermanent) && event.Attempts+1 < c.webhookMaxAttempts {
+		next := time.Now().UTC().Add(webhookBackoff(c.webhookRetryDelay, event.Attempts))
+		retryAt = &next
+	}
 
+	updated, err := c.db.FinishWebhookAttempt(event.ID, procErr, retryAt)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to decode params")
+		log.Printf("Failed to record attempt at webhook event %s: %s", event.ID, err)
 		return
 	}
+	if updated.Status == database.WebhookFailed {
+		log.Printf("Webhook event %s failed after %d attempts: %s", updated.ID, updated.Attempts, updated.LastError)
+	}
+}
+
+// webhookBackoff returns the delay before retrying an event that failed
+// attempts times before, doubling from delay up to an hour.
+func webhookBackoff(delay time.Duration, attempts int) time.Duration {
+	for i := 0; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	return min(delay, time.Hour)
+}
+
+// applyPolkaEvent acts on a Polka event. Events Chirpy does not use are
+// processed by ignoring them. A downgrade cancels the subscription at the
+// end of its period, a failed payment keeps it for the grace period and a
+// refund ends it right away. Events about a subscription not started yet are
+// retried, in case the upgrade arrives after them.
+func (c *apiConfig) applyPolkaEvent(event database.WebhookEvent) error {
+	req := polkaEvent{}
+	err := json.Unmarshal(event.Payload, &req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errWebhookPermanent, err)
+	}
 
+	action, ok := polkaSubscriptionActions[req.Event]
+	if !ok {
+		return nil
+	}
+	user, err := c.db.FindUserById(req.Data.UserId)
+	if err != nil {
+		return fmt.Errorf("%w: user %d does not exist", errWebhookPermanent, req.Data.UserId)
+	}
+
+	now := time.Now().UTC()
 	switch req.Event {
 	case "user.upgraded":
-		// upgrade user
-		user, err := c.db.FindUserById(req.Data.UserId)
-		if err != nil {
-			respondWithError(w, http.StatusNotFound, "User not found")
-			return
+		plan := req.Data.Plan
+		if plan == "" {
+			plan = database.PlanChirpyRed
+		}
+		expiresAt := req.Data.CurrentPeriodEnd
+		if expiresAt == nil {
+			end := now.Add(c.subscriptionPeriod)
+			expiresAt = &end
+		}
+		_, err = c.db.StartSubscription(user.ID, plan, database.SubscriptionSourcePolka, expiresAt)
+	case "user.renewed":
+		_, err = c.db.RenewSubscription(user.ID, req.Data.CurrentPeriodEnd, c.subscriptionPeriod)
+	case "user.downgraded":
+		_, err = c.db.CancelSubscription(user.ID)
+	case "user.payment_failed":
+		// the grace period starts once the period paid for is over
+		graceEndsAt := now
+		if sub, ok := user.CurrentSubscription(); ok && sub.ExpiresAt != nil && sub.ExpiresAt.After(now) {
+			graceEndsAt = *sub.ExpiresAt
 		}
+		_, err = c.db.MarkSubscriptionPastDue(user.ID, graceEndsAt.Add(c.subscriptionGrace))
+	case "user.refunded":
+		_, err = c.db.EndSubscription(user.ID, database.SubscriptionRefunded)
+	}
 
-		err = c.upgradeUser(user.Email)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "Error updating user")
+	c.recordEvent(nil, audit.Event{
+		Action:   action,
+		TargetID: user.ID,
+		Outcome:  outcome(err),
+		Detail:   "polka " + req.Event + " " + event.ID,
+	})
+	return err
+}
+
+// getWebhookEvents lists the inbox, optionally only events with a status.
+func (c *apiConfig) getWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != database.WebhookPending && status != database.WebhookProcessed && status != database.WebhookFailed {
+		respondWithError(w, http.StatusBadRequest, "status must be pending, processed or failed")
+		return
+	}
+
+	limit := defaultWebhookEventsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxWebhookEventsLimit {
+			respondWithError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxWebhookEventsLimit))
 			return
 		}
+		limit = n
+	}
 
-		respondWithJSON(w, http.StatusNoContent, Res{})
+	events, err := c.db.ListWebhookEvents(status, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
-	default:
-		respondWithJSON(w, http.StatusNoContent, Res{})
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
+
+func (c *apiConfig) getWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := c.db.GetWebhookEvent(r.PathValue("id"))
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	respondWithJSON(w, http.StatusOK, event)
 }
 
-func (c *apiConfig) upgradeUser(email string) error {
-	err := c.db.UpgradeUser(email)
+// replayWebhookEvent processes an event again, such as one that failed for
+// good or one that must be re-run after fixing data by hand.
+func (c *apiConfig) replayWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	event, err := c.db.ReplayWebhookEvent(r.PathValue("id"))
+	if errors.Is(err, database.ErrWebhookEventNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
 	if err != nil {
-		return err
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
-	return nil
+	c.recordEvent(r, audit.Event{Action: actionAdminWebhookReplay, Outcome: audit.OutcomeSuccess, Detail: event.ID})
+	c.wakeWebhookWorker()
+
+	respondWithJSON(w, http.StatusAccepted, event)
 }